@@ -0,0 +1,484 @@
+package gitfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"rsc.io/gitfs"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// repos holds the provisioned git filesystems that have a name,
+// so the admin API can address them. Every name maps to its instances
+// in the order they were provisioned, the last one being addressed:
+// during a config reload, the new instance is provisioned before the
+// old one is cleaned up, and should the reload fail, cleaning the new
+// instance up leaves the old one addressed again.
+var (
+	reposMu sync.RWMutex
+	repos   = make(map[string][]*Repo)
+)
+
+// registerRepo makes r addressable by its name.
+func registerRepo(r *Repo) {
+	if r.Name == "" {
+		return
+	}
+	reposMu.Lock()
+	defer reposMu.Unlock()
+	repos[r.Name] = append(repos[r.Name], r)
+}
+
+// unregisterRepo removes r from the registry, addressing the instance
+// provisioned before it again if r was the last one.
+func unregisterRepo(r *Repo) {
+	if r.Name == "" {
+		return
+	}
+	reposMu.Lock()
+	defer reposMu.Unlock()
+	all := repos[r.Name]
+	for i, repo := range all {
+		if repo == r {
+			all = append(all[:i:i], all[i+1:]...)
+			break
+		}
+	}
+	if len(all) == 0 {
+		delete(repos, r.Name)
+		return
+	}
+	repos[r.Name] = all
+}
+
+// checkNameUnique fails if a filesystem of the same config as r has
+// already registered its name. Instances of other configs, which are
+// being replaced by a reload, do not count.
+func checkNameUnique(r *Repo) error {
+	if r.Name == "" {
+		return nil
+	}
+	reposMu.RLock()
+	defer reposMu.RUnlock()
+	for _, repo := range repos[r.Name] {
+		if repo.caddyCtx.Context == r.caddyCtx.Context {
+			return fmt.Errorf("'name' %q is already used by another filesystem", r.Name)
+		}
+	}
+	return nil
+}
+
+// lookupRepo returns the registered filesystem with the given name.
+func lookupRepo(name string) (*Repo, bool) {
+	reposMu.RLock()
+	defer reposMu.RUnlock()
+	all := repos[name]
+	if len(all) == 0 {
+		return nil, false
+	}
+	return all[len(all)-1], true
+}
+
+// registeredRepos returns the registered filesystems, sorted by name.
+func registeredRepos() []*Repo {
+	reposMu.RLock()
+	all := make([]*Repo, 0, len(repos))
+	for _, instances := range repos {
+		all = append(all, instances[len(instances)-1])
+	}
+	reposMu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// adminAPI is a module that provides the /gitfs/ endpoints
+// for the Caddy admin API.
+type adminAPI struct{}
+
+// lookupReport is the result of resolving a path in a git filesystem.
+type lookupReport struct {
+	Filesystem string    `json:"filesystem"`
+	Path       string    `json:"path"`
+	Hash       string    `json:"hash"`
+	Exists     bool      `json:"exists"`
+	IsDir      bool      `json:"is_dir"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode,omitempty"`
+	ModTime    time.Time `json:"mod_time"`
+	OpenError  string    `json:"open_error,omitempty"`
+	StatError  string    `json:"stat_error,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.gitfs",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes for the /gitfs/ endpoints.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/gitfs/lookup/",
+			Handler: caddy.AdminHandlerFunc(a.handleLookup),
+		},
+		{
+			Pattern: "/gitfs/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/gitfs/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/gitfs/promote/",
+			Handler: caddy.AdminHandlerFunc(a.handlePromote),
+		},
+		{
+			Pattern: "/gitfs/reload-auth/",
+			Handler: caddy.AdminHandlerFunc(a.handleReloadAuth),
+		},
+		{
+			Pattern: "/gitfs/v1/state",
+			Handler: caddy.AdminHandlerFunc(a.handleState),
+		},
+		{
+			Pattern: "/gitfs/v1/state/",
+			Handler: caddy.AdminHandlerFunc(a.handleState),
+		},
+		{
+			Pattern: "/gitfs/refresh-all",
+			Handler: caddy.AdminHandlerFunc(a.handleRefreshAll),
+		},
+	}
+}
+
+// handleLookup reports how the requested path resolves in the
+// filesystem named by the `fs` query parameter.
+func (adminAPI) handleLookup(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	repo, err := repoFromQuery(r)
+	if err != nil {
+		return err
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/gitfs/lookup/"), "/")
+	if name == "" {
+		name = "."
+	}
+
+	report := lookupReport{
+		Filesystem: repo.Name,
+		Path:       name,
+		Hash:       repo.currentHash().String(),
+	}
+	if f, err := repo.Open(name); err != nil {
+		report.OpenError = err.Error()
+	} else {
+		f.Close()
+	}
+	if info, err := repo.Stat(name); err != nil {
+		report.StatError = err.Error()
+	} else {
+		report.Exists = true
+		report.IsDir = info.IsDir()
+		report.Size = info.Size()
+		report.Mode = info.Mode().String()
+		report.ModTime = info.ModTime()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// handleHealth reports whether the filesystem named by the `fs`
+// query parameter is healthy, responding with 503 if it is not.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	repo, err := repoFromQuery(r)
+	if err != nil {
+		return err
+	}
+	healthy := repo.Healthy()
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(map[string]bool{"healthy": healthy})
+}
+
+// statsReport is the size of the commit served by a git filesystem.
+type statsReport struct {
+	Filesystem string       `json:"filesystem"`
+	Hash       string       `json:"hash"`
+	Objects    int          `json:"objects"`
+	Size       int64        `json:"size"`
+	Staged     string       `json:"staged,omitempty"`
+	Changes    []pathChange `json:"changes,omitempty"`
+}
+
+// handleStats reports the number of objects and the total size of
+// the commit served by the filesystem named by the `fs` query parameter.
+func (adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	repo, err := repoFromQuery(r)
+	if err != nil {
+		return err
+	}
+	snap := repo.current.Load()
+	report := statsReport{
+		Filesystem: repo.Name,
+		Hash:       snap.hash.String(),
+		Objects:    snap.objects,
+		Size:       snap.size,
+		Changes:    snap.changes,
+	}
+	if h, ok := repo.stagedHash(); ok {
+		report.Staged = h.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// handlePromote serves the commit staged for the filesystem named in
+// the path, in `manual_promote` mode.
+func (adminAPI) handlePromote(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	repo, err := repoFromPath(r, "/gitfs/promote/")
+	if err != nil {
+		return err
+	}
+	old, promoted, err := repo.promote()
+	if errors.Is(err, errNothingStaged) {
+		return caddy.APIError{HTTPStatus: http.StatusConflict, Err: err}
+	}
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{
+		"filesystem": repo.Name,
+		"old":        old.String(),
+		"new":        promoted.String(),
+	})
+}
+
+// handleReloadAuth reloads the credentials of the filesystem named
+// in the path, without reloading the config.
+func (adminAPI) handleReloadAuth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	repo, err := repoFromPath(r, "/gitfs/reload-auth/")
+	if err != nil {
+		return err
+	}
+	if err := repo.reloadAuth(); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// refreshReport is the outcome of refreshing a git filesystem.
+type refreshReport struct {
+	Filesystem string `json:"filesystem"`
+	Old        string `json:"old"`
+	New        string `json:"new,omitempty"`
+	Changed    bool   `json:"changed"`
+	Duration   string `json:"duration"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleRefreshAll refreshes every registered filesystem in turn,
+// reporting the outcome of each. Refreshing one at a time bounds the
+// clones in flight and the memory they take.
+func (adminAPI) handleRefreshAll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	all := registeredRepos()
+	reports := make([]refreshReport, 0, len(all))
+	for _, repo := range all {
+		res, err := repo.pull()
+		report := refreshReport{
+			Filesystem: repo.Name,
+			Old:        res.old.String(),
+			Changed:    res.changed,
+			Duration:   res.duration.String(),
+		}
+		if res.new != (gitfs.Hash{}) {
+			report.New = res.new.String()
+		}
+		repo.recordRefresh(err)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(reports)
+}
+
+// stateV1 is version 1 of the runtime state of a git filesystem, as
+// served by /gitfs/v1/state. Fields may be added to it, but none are
+// removed or changed in meaning without a new version of the endpoint.
+type stateV1 struct {
+	Filesystem  string    `json:"filesystem"`
+	URL         string    `json:"url"`
+	ActiveURL   string    `json:"active_url"`
+	Ref         string    `json:"ref"`
+	Hash        string    `json:"hash"`
+	Staged      string    `json:"staged,omitempty"`
+	Refused     string    `json:"refused,omitempty"`
+	Objects     int       `json:"objects"`
+	Size        int64     `json:"size"`
+	Healthy     bool      `json:"healthy"`
+	Stale       bool      `json:"stale"`
+	LastRefresh time.Time `json:"last_refresh"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	CircuitOpen         bool `json:"circuit_open"`
+	ConsecutiveFailures int  `json:"consecutive_failures"`
+}
+
+// state returns the runtime state of r.
+func (r *Repo) state() stateV1 {
+	snap := r.current.Load()
+	st := stateV1{
+		Filesystem:  r.Name,
+		URL:         redactURL(r.URL),
+		ActiveURL:   redactURL(r.remoteURL(r.remote.Load().mirror)),
+		Ref:         r.Ref,
+		Hash:        snap.hash.String(),
+		Objects:     snap.objects,
+		Size:        snap.size,
+		Healthy:     r.Healthy(),
+		Stale:       r.stale(),
+		LastRefresh: time.Unix(0, r.refreshed.Load()).UTC(),
+
+		CircuitOpen:         r.circuitOpen.Load(),
+		ConsecutiveFailures: int(r.failures.Load()),
+	}
+	if h, ok := r.stagedHash(); ok {
+		st.Staged = h.String()
+	}
+	if h := r.refused.Load(); h != nil {
+		st.Refused = h.String()
+	}
+	if err := r.refreshErr.Load(); err != nil {
+		st.LastError = (*err).Error()
+	}
+	return st
+}
+
+// redactURL returns the URL raw without its userinfo, or an empty
+// string if it cannot be parsed, so credentials never leave the config.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+// handleState reports the runtime state of the filesystem named in
+// the path, or of all named filesystems under `filesystems`, sorted
+// by name, if no name is given.
+func (adminAPI) handleState(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Trim(strings.TrimPrefix(r.URL.Path, "/gitfs/v1/state"), "/") != "" {
+		repo, err := repoFromPath(r, "/gitfs/v1/state/")
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(repo.state())
+	}
+	all := registeredRepos()
+	states := make([]stateV1, 0, len(all))
+	for _, repo := range all {
+		states = append(states, repo.state())
+	}
+	return json.NewEncoder(w).Encode(map[string][]stateV1{"filesystems": states})
+}
+
+// repoFromPath returns the registered filesystem named by the
+// request path following prefix.
+func repoFromPath(r *http.Request, prefix string) (*Repo, error) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	repo, ok := lookupRepo(name)
+	if !ok {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown git filesystem %q", name),
+		}
+	}
+	return repo, nil
+}
+
+// repoFromQuery returns the registered filesystem named by the
+// `fs` query parameter of the request.
+func repoFromQuery(r *http.Request) (*Repo, error) {
+	name := r.URL.Query().Get("fs")
+	if name == "" {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing 'fs' query parameter"),
+		}
+	}
+	repo, ok := lookupRepo(name)
+	if !ok {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown git filesystem %q", name),
+		}
+	}
+	return repo, nil
+}
+
+var _ caddy.AdminRouter = adminAPI{}
@@ -0,0 +1,60 @@
+package gitfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRegistry(t *testing.T) {
+	newRepo := func() *Repo {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return &Repo{Name: "registry", caddyCtx: caddy.Context{Context: ctx}}
+	}
+	lookup := func() *Repo {
+		r, _ := lookupRepo("registry")
+		return r
+	}
+
+	old, replacing := newRepo(), newRepo()
+	registerRepo(old)
+	if err := checkNameUnique(replacing); err != nil {
+		t.Fatalf("instance of another config: %v", err)
+	}
+	registerRepo(replacing)
+	if lookup() != replacing {
+		t.Fatal("the new instance is not addressed")
+	}
+
+	// a reload failing cleans the new instance up first
+	unregisterRepo(replacing)
+	if lookup() != old {
+		t.Fatal("the old instance is not addressed again after the new one is cleaned up")
+	}
+
+	// a reload succeeding cleans the old instance up
+	registerRepo(replacing)
+	unregisterRepo(old)
+	if lookup() != replacing {
+		t.Fatal("the new instance is not addressed after the old one is cleaned up")
+	}
+	unregisterRepo(replacing)
+	if r, ok := lookupRepo("registry"); ok {
+		t.Fatalf("instance %p still addressed after cleanup", r)
+	}
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	ctx := caddy.Context{Context: context.Background()}
+	first := &Repo{Name: "duplicate", caddyCtx: ctx}
+	registerRepo(first)
+	defer unregisterRepo(first)
+	if err := checkNameUnique(&Repo{Name: "duplicate", caddyCtx: ctx}); err == nil {
+		t.Fatal("duplicate name in the same config accepted")
+	}
+	if err := checkNameUnique(&Repo{caddyCtx: ctx}); err != nil {
+		t.Fatalf("unnamed filesystem: %v", err)
+	}
+}
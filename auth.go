@@ -0,0 +1,190 @@
+package gitfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultTokenUsername is the username sent along a token read from
+// `token_file`. Hosts accepting tokens over basic authentication
+// generally ignore the username; GitHub expects this one for app
+// installation tokens.
+const defaultTokenUsername = "x-access-token"
+
+// A TokenSource provides the credentials to authenticate to the
+// remote with. It is queried at provision, before every refresh and
+// when the credentials are reloaded through the admin API, so it can
+// mint short-lived tokens; the remote is reconnected to whenever the
+// credentials change. Custom sources are Caddy modules in the
+// `gitfs.token_sources` namespace, set as the `source` of `auth`.
+type TokenSource interface {
+	Token(ctx context.Context) (username, token string, err error)
+}
+
+// Auth holds the credentials used to authenticate to the remote.
+// rsc.io/gitfs cannot send custom headers, so credentials are sent
+// with HTTP basic authentication.
+type Auth struct {
+	// The username for basic authentication. Default when
+	// `token_file` is set: `x-access-token`
+	Username string `json:"username,omitempty"`
+
+	// The password for basic authentication. It may use the
+	// placeholders accepted in the URL.
+	Password string `json:"password,omitempty"`
+
+	// The path of a file holding the password or token, read at
+	// provision, before every refresh, and when the credentials are
+	// reloaded through the admin API.
+	TokenFile string `json:"token_file,omitempty"`
+
+	// The token source module providing the credentials instead.
+	SourceRaw json.RawMessage `json:"source,omitempty" caddy:"namespace=gitfs.token_sources inline_key=source"`
+
+	source TokenSource
+}
+
+// validate checks the configuration for errors.
+func (a *Auth) validate() error {
+	if a.Password != "" && a.TokenFile != "" {
+		return fmt.Errorf("'password' and 'token_file' are mutually exclusive")
+	}
+	if a.SourceRaw != nil && (a.Username != "" || a.Password != "" || a.TokenFile != "") {
+		return fmt.Errorf("'source' provides the credentials; 'username', 'password' and 'token_file' cannot be set with it")
+	}
+	return nil
+}
+
+// provision sets up the token source, loading the `source` module
+// if there is one.
+func (a *Auth) provision(ctx caddy.Context) error {
+	switch {
+	case a.SourceRaw != nil:
+		mod, err := ctx.LoadModule(a, "SourceRaw")
+		if err != nil {
+			return fmt.Errorf("loading token source: %v", err)
+		}
+		src, ok := mod.(TokenSource)
+		if !ok {
+			return fmt.Errorf("module %T is not a gitfs.TokenSource", mod)
+		}
+		a.source = src
+	case a.TokenFile != "":
+		a.source = fileToken{a.TokenFile, a.Username}
+	default:
+		a.source = staticToken{ctx, a.Username, a.Password}
+	}
+	return nil
+}
+
+// apply returns repoURL with the credentials of the token source set
+// in its userinfo.
+func (a *Auth) apply(ctx context.Context, repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("the URL already holds credentials")
+	}
+	user, pass, err := a.source.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	if user == "" || pass == "" {
+		return "", fmt.Errorf("both a username and a password or token are required")
+	}
+	u.User = url.UserPassword(user, pass)
+	return u.String(), nil
+}
+
+// staticToken is the TokenSource of `basic` credentials, resolving
+// the placeholders of the password every time.
+type staticToken struct {
+	ctx      caddy.Context
+	username string
+	password string
+}
+
+func (s staticToken) Token(context.Context) (string, string, error) {
+	pass, err := resolveSecret(s.ctx, s.password)
+	if err != nil {
+		return "", "", fmt.Errorf("resolving 'password': %v", err)
+	}
+	return s.username, pass, nil
+}
+
+// fileToken is the TokenSource of `token_file`, reading the file
+// every time.
+type fileToken struct {
+	path     string
+	username string
+}
+
+func (f fileToken) Token(context.Context) (string, string, error) {
+	token, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", "", fmt.Errorf("reading 'token_file': %v", err)
+	}
+	user := f.username
+	if user == "" {
+		user = defaultTokenUsername
+	}
+	return user, strings.TrimSpace(string(token)), nil
+}
+
+// unmarshalCaddyfile sets up a from an `auth` block.
+func (a *Auth) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "basic":
+			if !d.Args(&a.Username, &a.Password) {
+				return d.ArgErr()
+			}
+		case "token_file":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			a.TokenFile = args[0]
+			if len(args) == 2 {
+				a.Username = args[1]
+			}
+		case "source":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if a.SourceRaw != nil {
+				return d.Err("token source already specified")
+			}
+			name := d.Val()
+			modID := "gitfs.token_sources." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(TokenSource); !ok {
+				return d.Errf("module %s (%T) is not a gitfs.TokenSource", modID, unm)
+			}
+			a.SourceRaw = caddyconfig.JSONModuleObject(unm, "source", name, nil)
+		case "bearer", "header":
+			return d.Errf("%s authentication is not supported: the git client cannot send custom headers; use 'basic', 'token_file' or 'source'", d.Val())
+		default:
+			return d.Errf("unrecognized auth subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+var (
+	_ TokenSource = staticToken{}
+	_ TokenSource = fileToken{}
+)
@@ -0,0 +1,85 @@
+package gitfs
+
+import (
+	"io/fs"
+	"sort"
+
+	"rsc.io/gitfs"
+)
+
+// A pathChange is a file added, modified or deleted between two commits.
+type pathChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+}
+
+// diffSnapshots returns the files that differ between the trees of
+// two commits, sorted by path. Files are compared by blob hash, so a
+// file whose content did not change is not reported even if it moved.
+func diffSnapshots(old, new *snapshot) ([]pathChange, error) {
+	before, err := old.blobIndex()
+	if err != nil {
+		return nil, err
+	}
+	after, err := new.blobIndex()
+	if err != nil {
+		return nil, err
+	}
+	return diffBlobs(before.byPath, after.byPath), nil
+}
+
+// diffBlobs returns the paths whose blob hash differs between before
+// and after, sorted by path.
+func diffBlobs(before, after map[string]gitfs.Hash) []pathChange {
+	var changes []pathChange
+	for name, h := range after {
+		prev, ok := before[name]
+		switch {
+		case !ok:
+			changes = append(changes, pathChange{name, "added"})
+		case prev != h:
+			changes = append(changes, pathChange{name, "modified"})
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, pathChange{name, "deleted"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// A blobIndex maps the files of a tree to their blob hash and back.
+// A blob held by several files maps back to the first in lexical
+// order.
+type blobIndex struct {
+	byPath map[string]gitfs.Hash
+	byHash map[gitfs.Hash]string
+}
+
+// indexBlobs hashes every file in the tree.
+func indexBlobs(fsys fs.FS) (blobIndex, error) {
+	index := blobIndex{
+		byPath: make(map[string]gitfs.Hash),
+		byHash: make(map[gitfs.Hash]string),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		h := blobHash(data)
+		index.byPath[name] = h
+		if _, ok := index.byHash[h]; !ok {
+			index.byHash[h] = name
+		}
+		return nil
+	})
+	return index, err
+}
@@ -0,0 +1,66 @@
+package gitfs
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+func TestBlobIndex(t *testing.T) {
+	tree := fstest.MapFS{
+		"a.txt":       {Data: []byte("a")},
+		"dir/b.txt":   {Data: []byte("b")},
+		"dir/dup.txt": {Data: []byte("a")},
+	}
+	snap := &snapshot{tree: tree}
+	index, err := snap.blobIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.byPath) != 3 {
+		t.Fatalf("indexed %d files, want 3", len(index.byPath))
+	}
+	if h := blobHash([]byte("a")); index.byPath["dir/dup.txt"] != h || index.byHash[h] != "a.txt" {
+		t.Errorf("duplicate blob indexed as %s, mapping back to %q", index.byPath["dir/dup.txt"], index.byHash[h])
+	}
+
+	r := &Repo{current: &atomic.Pointer[snapshot]{}}
+	r.current.Store(snap)
+	f, err := r.OpenHash(blobHash([]byte("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "b" {
+		t.Errorf("OpenHash opened %q, want b", data)
+	}
+	if _, err := r.OpenHash(blobHash([]byte("missing"))); err == nil {
+		t.Error("OpenHash found a blob missing from the tree")
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	old := &snapshot{tree: fstest.MapFS{
+		"kept.txt":    {Data: []byte("kept")},
+		"changed.txt": {Data: []byte("v1")},
+		"deleted.txt": {Data: []byte("gone")},
+	}}
+	new := &snapshot{tree: fstest.MapFS{
+		"kept.txt":    {Data: []byte("kept")},
+		"changed.txt": {Data: []byte("v2")},
+		"dir/new.txt": {Data: []byte("new")},
+	}}
+	changes, err := diffSnapshots(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pathChange{
+		{"changed.txt", "modified"},
+		{"deleted.txt", "deleted"},
+		{"dir/new.txt", "added"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+}
@@ -1,6 +1,23 @@
 package gitfs
 
-import "io/fs"
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"rsc.io/gitfs"
+)
 
 type statFs struct {
 	fs.FS
@@ -15,7 +32,407 @@ func (s statFs) Stat(name string) (fs.FileInfo, error) {
 	return f.Stat()
 }
 
+// TextNormalize configures the normalization of text files as
+// they are read.
+type TextNormalize struct {
+	// The extensions, including the leading dot, of the files to
+	// normalize, e.g. `.txt`.
+	Extensions []string `json:"extensions,omitempty"`
+
+	// Convert CRLF line endings to LF. A leading UTF-8 BOM is
+	// always stripped.
+	CRLF bool `json:"crlf,omitempty"`
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// A textFS normalizes the content of the files matching its
+// configured extensions.
+type textFS struct {
+	fs.FS
+	cfg *TextNormalize
+}
+
+// Open implements fs.FS.
+func (t textFS) Open(name string) (fs.File, error) {
+	f, err := t.FS.Open(name)
+	if err != nil || !hasExtension(name, t.cfg.Extensions) {
+		return f, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	data = bytes.TrimPrefix(data, utf8BOM)
+	if t.cfg.CRLF {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	}
+	return newMemFile(info, data), nil
+}
+
+// Charset configures the transcoding of files committed in a legacy
+// character set to UTF-8 as they are read.
+type Charset struct {
+	// The name of the character set the files are encoded in, as
+	// registered for the web, e.g. `iso-8859-1` or `windows-1252`.
+	Name string `json:"name,omitempty"`
+
+	// The glob patterns of the files to transcode, matched against
+	// the path and against the file name, e.g. `legacy/*` or `*.txt`.
+	Files []string `json:"files,omitempty"`
+}
+
+// encoding returns the encoding named by the config.
+func (c *Charset) encoding() (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown character set %q", c.Name)
+	}
+	return enc, nil
+}
+
+// A charsetFS transcodes the files matching its globs to UTF-8.
+type charsetFS struct {
+	fs.FS
+	enc   encoding.Encoding
+	globs []string
+}
+
+// Open implements fs.FS.
+func (c charsetFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil || !matchesGlob(name, c.globs) {
+		return f, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	// the decoders replace invalid sequences with U+FFFD; should one
+	// fail regardless, serving the content as is beats failing
+	if utf8, err := c.enc.NewDecoder().Bytes(data); err == nil {
+		data = utf8
+	}
+	return newMemFile(info, data), nil
+}
+
+// matchesGlob reports whether name, or its base name, matches one
+// of globs.
+func matchesGlob(name string, globs []string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(g, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExtension reports whether name ends in one of exts,
+// ignoring case.
+func hasExtension(name string, exts []string) bool {
+	ext := path.Ext(name)
+	for _, e := range exts {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// A sizeLimitFS hides the regular files larger than max, as if they
+// were not part of the tree.
+type sizeLimitFS struct {
+	fs.FS
+	max int64
+}
+
+// Open implements fs.FS.
+func (l sizeLimitFS) Open(name string) (fs.File, error) {
+	f, err := l.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		if dir, ok := f.(fs.ReadDirFile); ok {
+			return filterDir{dir, l.keep}, nil
+		}
+		return f, nil
+	}
+	if info.Size() > l.max {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// keep reports whether the directory entry e is within the limit.
+func (l sizeLimitFS) keep(e fs.DirEntry) bool {
+	if e.IsDir() {
+		return true
+	}
+	info, err := e.Info()
+	return err != nil || info.Size() <= l.max
+}
+
+// An extensionFS hides the regular files whose extension is not
+// one of exts, as if they were not part of the tree.
+type extensionFS struct {
+	fs.FS
+	exts []string
+}
+
+// Open implements fs.FS.
+func (x extensionFS) Open(name string) (fs.File, error) {
+	f, err := x.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		if dir, ok := f.(fs.ReadDirFile); ok {
+			return filterDir{dir, x.keep}, nil
+		}
+		return f, nil
+	}
+	if !hasExtension(name, x.exts) {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// keep reports whether the directory entry e has an allowed extension.
+func (x extensionFS) keep(e fs.DirEntry) bool {
+	return e.IsDir() || hasExtension(e.Name(), x.exts)
+}
+
+// filterDir leaves the entries keep rejects out of the listing of
+// a directory.
+type filterDir struct {
+	fs.ReadDirFile
+	keep func(fs.DirEntry) bool
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d filterDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		kept := entries[:0]
+		for _, e := range entries {
+			if d.keep(e) {
+				kept = append(kept, e)
+			}
+		}
+		// a non-empty listing must not be reported as empty
+		if len(kept) > 0 || err != nil || n <= 0 || len(entries) == 0 {
+			return kept, err
+		}
+	}
+}
+
+// A memFile is a regular file served from a transformed copy of
+// the blob content. Like the blobs of rsc.io/gitfs, it is seekable
+// and reports its size, which the file server needs to sniff the
+// content type and serve range requests, and which lets the encode
+// handler compress it.
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+// memFileInfo reports the size of the transformed content.
+type memFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i memFileInfo) Size() int64 { return i.size }
+
+func newMemFile(info fs.FileInfo, data []byte) *memFile {
+	return &memFile{bytes.NewReader(data), memFileInfo{info, int64(len(data))}}
+}
+
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// emptyFS is the tree of a repository without commits.
+type emptyFS struct{}
+
+// Open implements fs.FS.
+func (emptyFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		return emptyDir{}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// emptyDir is the root directory of an emptyFS.
+type emptyDir struct{}
+
+func (emptyDir) Close() error               { return nil }
+func (emptyDir) Stat() (fs.FileInfo, error) { return emptyDirInfo{}, nil }
+
+func (emptyDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+
+func (emptyDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n > 0 {
+		return nil, io.EOF
+	}
+	return nil, nil
+}
+
+// emptyDirInfo describes the root directory of an emptyFS.
+type emptyDirInfo struct{}
+
+func (emptyDirInfo) Name() string       { return "." }
+func (emptyDirInfo) Size() int64        { return 0 }
+func (emptyDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (emptyDirInfo) ModTime() time.Time { return time.Time{} }
+func (emptyDirInfo) IsDir() bool        { return true }
+func (emptyDirInfo) Sys() any           { return nil }
+
+// errFS fails every lookup with err.
+type errFS struct {
+	err error
+}
+
+// Open implements fs.FS.
+func (e errFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: e.err}
+}
+
+// gapError returns the error lookups fail with while no content is
+// served, for the file server to respond with status 503. It carries
+// only err, a message safe to show to clients, and id, which is also
+// logged with the details so reports can be matched to the logs. Both
+// are available to `handle_errors` as `{http.error.message}` and
+// `{http.error.id}`.
+func gapError(id string, err error) error {
+	return caddyhttp.HandlerError{
+		StatusCode: http.StatusServiceUnavailable,
+		ID:         id,
+		Err:        err,
+	}
+}
+
+// errorID returns a random ID to correlate an error with its log entry.
+func errorID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// stripComponents returns the directory n levels below the root of
+// fsys, failing unless every level holds a single directory.
+func stripComponents(fsys fs.FS, n int) (fs.FS, error) {
+	dir := "."
+	for i := 0; i < n; i++ {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		next := ""
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			if next != "" {
+				return nil, fmt.Errorf("%s holds more than one directory", dir)
+			}
+			next = path.Join(dir, e.Name())
+		}
+		if next == "" {
+			return nil, fmt.Errorf("%s holds no directory", dir)
+		}
+		dir = next
+	}
+	return fs.Sub(fsys, dir)
+}
+
+// walkStats returns the number of trees and blobs in fsys and the
+// total size of the blobs.
+func walkStats(fsys fs.FS) (objects int, size int64, err error) {
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		objects++
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return objects, size, err
+}
+
+// verifyTree reads every directory and file of fsys, failing on the
+// first object that cannot be read. Cloned objects are indexed by the
+// hash of their content, so a corrupted object does not match the hash
+// its tree refers to and surfaces here as missing.
+func verifyTree(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		_, err = fs.ReadFile(fsys, name)
+		return err
+	})
+}
+
+// blobHash returns the git object hash of a blob holding data.
+func blobHash(data []byte) gitfs.Hash {
+	s := sha1.New()
+	fmt.Fprintf(s, "blob %d\x00", len(data))
+	s.Write(data)
+	var h gitfs.Hash
+	s.Sum(h[:0])
+	return h
+}
+
 var (
 	_ fs.StatFS = statFs{}
 	_ fs.FS     = statFs{}
+	_ fs.FS     = textFS{}
+	_ fs.FS     = charsetFS{}
+	_ fs.FS     = emptyFS{}
+	_ fs.FS     = sizeLimitFS{}
+	_ fs.FS     = errFS{}
+	_ fs.File   = (*memFile)(nil)
+
+	_ fs.ReadDirFile = emptyDir{}
+	_ fs.ReadDirFile = filterDir{}
+
+	_ io.ReadSeeker = (*memFile)(nil)
+	_ io.ReaderAt   = (*memFile)(nil)
 )
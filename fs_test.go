@@ -0,0 +1,214 @@
+package gitfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestTransformedFilesSeekable(t *testing.T) {
+	tree := fstest.MapFS{
+		"crlf.txt":   {Data: []byte("\xef\xbb\xbfline 1\r\nline 2\r\n")},
+		"latin1.txt": {Data: []byte("caf\xe9")},
+	}
+	for _, tt := range []struct {
+		fsys fs.FS
+		name string
+		want string
+	}{
+		{textFS{tree, &TextNormalize{Extensions: []string{".txt"}, CRLF: true}}, "crlf.txt", "line 1\nline 2\n"},
+		{charsetFS{tree, charmap.ISO8859_1, []string{"*.txt"}}, "latin1.txt", "café"},
+	} {
+		f, err := tt.fsys.Open(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(tt.want)) {
+			t.Errorf("%s: size %d, want the transformed size %d", tt.name, info.Size(), len(tt.want))
+		}
+		rs, ok := f.(io.ReadSeeker)
+		if !ok {
+			t.Fatalf("%s: %T is not seekable", tt.name, f)
+		}
+		if end, err := rs.Seek(0, io.SeekEnd); err != nil || end != info.Size() {
+			t.Errorf("%s: seeking to the end returned %d, %v, want %d", tt.name, end, err, info.Size())
+		}
+		if _, err := rs.Seek(1, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if rest, _ := io.ReadAll(rs); string(rest) != tt.want[1:] {
+			t.Errorf("%s: read %q after seeking, want %q", tt.name, rest, tt.want[1:])
+		}
+		f.Close()
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	rem := newTestRemote(t, map[string]string{"video.bin": content, "notes.txt": "\xef\xbb\xbf" + content})
+	err := loadRepos(t, map[string]any{
+		"name":           "range",
+		"url":            rem.URL,
+		"text_normalize": map[string]any{"extensions": []string{".txt"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := lookupRepo("range")
+	srv := http.FileServer(http.FS(r))
+	// a blob as cloned, and one transformed in memory
+	for _, name := range []string{"video.bin", "notes.txt"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/"+name, nil)
+		req.Header.Set("Range", "bytes=5000-5009")
+		srv.ServeHTTP(w, req)
+		if w.Code != http.StatusPartialContent || w.Body.String() != content[5000:5010] {
+			t.Errorf("%s: status %d, body %q", name, w.Code, w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes 5000-5009/%d", len(content)) {
+			t.Errorf("%s: Content-Range %q", name, cr)
+		}
+	}
+}
+
+func TestMemFileReadAt(t *testing.T) {
+	f := newMemFile(emptyDirInfo{}, []byte("0123456789"))
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, 3); err != nil || string(buf[:n]) != "3456" {
+		t.Errorf("ReadAt = %q, %v", buf[:n], err)
+	}
+	if n, err := f.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "89" {
+		t.Errorf("ReadAt past the end = %q, %v, want io.EOF", buf[:n], err)
+	}
+	// ReadAt does not move the offset of Read
+	if data, _ := io.ReadAll(f); string(data) != "0123456789" {
+		t.Errorf("Read after ReadAt = %q", data)
+	}
+}
+
+func TestFilterDir(t *testing.T) {
+	tree := fstest.MapFS{
+		"a.bin":       {Data: []byte("a")},
+		"b.bin":       {Data: []byte("b")},
+		"c.bin":       {Data: []byte("c")},
+		"big.html":    {Data: []byte(strings.Repeat("x", 100))},
+		"index.html":  {Data: []byte("<p>")},
+		"dir/x.bin":   {Data: []byte("x")},
+		"style.css":   {Data: []byte("p{}")},
+		"z.bin":       {Data: []byte("z")},
+		"large/f.css": {Data: []byte(strings.Repeat("x", 100))},
+	}
+	for _, tt := range []struct {
+		name string
+		fsys fs.FS
+		want []string
+	}{
+		{"extensions", extensionFS{tree, []string{".html", ".css"}}, []string{"big.html", "dir", "index.html", "large", "style.css"}},
+		{"size", sizeLimitFS{tree, 10}, []string{"a.bin", "b.bin", "c.bin", "dir", "index.html", "large", "style.css", "z.bin"}},
+	} {
+		entries, err := fs.ReadDir(tt.fsys, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if strings.Join(names, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: listed %v, want %v", tt.name, names, tt.want)
+		}
+
+		// reading one entry at a time must not end the listing early on
+		// entries that are filtered out
+		dir, err := tt.fsys.Open(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paged []string
+		for {
+			entries, err := dir.(fs.ReadDirFile).ReadDir(1)
+			for _, e := range entries {
+				paged = append(paged, e.Name())
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) == 0 {
+				t.Fatalf("%s: empty page without io.EOF", tt.name)
+			}
+		}
+		dir.Close()
+		if strings.Join(paged, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: paged listing %v, want %v", tt.name, paged, tt.want)
+		}
+	}
+
+	if _, err := (extensionFS{tree, []string{".html"}}).Open("a.bin"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a filtered extension = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := (sizeLimitFS{tree, 10}).Open("big.html"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening an oversized file = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := (extensionFS{tree, []string{".HTML"}}).Open("index.html"); err != nil {
+		t.Errorf("extensions are not matched ignoring case: %v", err)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	tree := fstest.MapFS{
+		"README.md":                {Data: []byte("readme")},
+		"site/index.html":          {Data: []byte("index")},
+		"site/public/app.js":       {Data: []byte("app")},
+		"site/public/img/logo.png": {Data: []byte("logo")},
+	}
+	for _, tt := range []struct {
+		n       int
+		open    string
+		wantErr bool
+	}{
+		{n: 0, open: "site/index.html"},
+		{n: 1, open: "index.html"},
+		{n: 1, open: "public/app.js"},
+		{n: 2, open: "app.js"},
+		{n: 3, open: "logo.png"},
+		{n: 4, wantErr: true}, // site/public/img holds no directory
+	} {
+		sub, err := stripComponents(tree, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("strip %d: err = %v, want error: %v", tt.n, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := fs.Stat(sub, tt.open); err != nil {
+			t.Errorf("strip %d: %v", tt.n, err)
+		}
+	}
+
+	// files next to the stripped directory are not served
+	sub, _ := stripComponents(tree, 1)
+	if _, err := fs.Stat(sub, "README.md"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file next to the stripped directory: %v", err)
+	}
+
+	tree["other/index.html"] = &fstest.MapFile{Data: []byte("other")}
+	if _, err := stripComponents(tree, 1); err == nil {
+		t.Error("stripped a level holding more than one directory")
+	}
+}
@@ -0,0 +1,141 @@
+package gitfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// testRemote is a git repository served over HTTP by git-http-backend,
+// so tests can clone from and push to a remote without the network.
+type testRemote struct {
+	t   testing.TB
+	dir string // holds the bare repo.git and its work tree src
+	URL string
+}
+
+// newTestRemote serves a bare repository whose main branch holds a
+// commit of files, skipping the test if git is not installed.
+func newTestRemote(t testing.TB, files map[string]string) *testRemote {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	out, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skipf("locating git-http-backend: %v", err)
+	}
+	dir := t.TempDir()
+	rem := &testRemote{t: t, dir: dir}
+	rem.git(dir, "init", "-q", "--bare", "-b", "main", "repo.git")
+	rem.git(dir, "init", "-q", "-b", "main", "src")
+	rem.Commit(files)
+
+	srv := httptest.NewServer(&cgi.Handler{
+		Path:   filepath.Join(strings.TrimSpace(string(out)), "git-http-backend"),
+		Env:    []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: io.Discard,
+	})
+	t.Cleanup(srv.Close)
+	rem.URL = srv.URL + "/repo.git"
+	return rem
+}
+
+// git runs git in dir, failing the test on error.
+func (rem *testRemote) git(dir string, args ...string) string {
+	rem.t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		rem.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Commit writes files to the work tree, deleting those with empty
+// content, commits them and pushes the commit to main, returning its
+// hash.
+func (rem *testRemote) Commit(files map[string]string) string {
+	rem.t.Helper()
+	src := filepath.Join(rem.dir, "src")
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if content == "" {
+			if err := os.Remove(p); err != nil {
+				rem.t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			rem.t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			rem.t.Fatal(err)
+		}
+	}
+	rem.git(src, "add", "-A")
+	rem.git(src, "commit", "-q", "--allow-empty", "-m", "commit")
+	rem.Push("HEAD:refs/heads/main")
+	return rem.git(src, "rev-parse", "HEAD")
+}
+
+// Push pushes refspec from the work tree to the remote.
+func (rem *testRemote) Push(refspec string) {
+	rem.t.Helper()
+	rem.git(filepath.Join(rem.dir, "src"), "push", "-q", "-f", "../repo.git", refspec)
+}
+
+// testApp is a Caddy app provisioning git filesystems, so tests can
+// load them through a config as Caddy does.
+type testApp struct {
+	Filesystems []json.RawMessage `json:"filesystems,omitempty"`
+}
+
+func (testApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "gitfs_test",
+		New: func() caddy.Module { return new(testApp) },
+	}
+}
+
+func (a *testApp) Provision(ctx caddy.Context) error {
+	for i, raw := range a.Filesystems {
+		if _, err := ctx.LoadModuleByID("caddy.fs.git", raw); err != nil {
+			return fmt.Errorf("filesystem %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (testApp) Start() error { return nil }
+func (testApp) Stop() error  { return nil }
+
+func init() {
+	caddy.RegisterModule(testApp{})
+}
+
+// loadRepos loads a Caddy config provisioning the given filesystem
+// configs, stopping Caddy when the test ends.
+func loadRepos(t testing.TB, configs ...map[string]any) error {
+	t.Helper()
+	cfg, err := json.Marshal(map[string]any{
+		"admin":   map[string]any{"disabled": true},
+		"logging": map[string]any{"logs": map[string]any{"default": map[string]any{"level": "ERROR"}}},
+		"apps":    map[string]any{"gitfs_test": map[string]any{"filesystems": configs}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	return caddy.Load(cfg, true)
+}
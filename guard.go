@@ -0,0 +1,117 @@
+package gitfs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Guard{})
+	httpcaddyfile.RegisterHandlerDirective("gitfs_guard", parseGuard)
+}
+
+// Guard is a middleware refusing requests whose Host is not in the
+// `allowed_hosts` of a named git filesystem with status 404, so that
+// a route misconfigured onto an unintended site does not expose the
+// repository. The filesystem has no access to the request, so the
+// guard goes in front of the file server serving it. The gitfs
+// handlers apply the same check on their own.
+type Guard struct {
+	// The name of the git filesystem
+	Filesystem string `json:"filesystem,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Guard) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.gitfs_guard",
+		New: func() caddy.Module { return new(Guard) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (g *Guard) Provision(ctx caddy.Context) error {
+	if g.Filesystem == "" {
+		return fmt.Errorf("'filesystem' is empty")
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (g Guard) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repo, ok := lookupRepo(g.Filesystem)
+	if !ok {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("unknown git filesystem %q", g.Filesystem))
+	}
+	if err := repo.checkHost(r); err != nil {
+		return err
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// checkHost returns a 404 handler error if `allowed_hosts` is set and
+// the Host of the request is not one of them.
+func (r *Repo) checkHost(req *http.Request) error {
+	if len(r.AllowedHosts) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	for _, allowed := range r.AllowedHosts {
+		if hostMatches(allowed, host) {
+			return nil
+		}
+	}
+	return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("host %q is not allowed to serve git filesystem %q", host, r.Name))
+}
+
+// hostMatches reports whether host matches pattern, ignoring case. A
+// leading `*.` in the pattern matches a single label, as in the host
+// matcher.
+func hostMatches(pattern, host string) bool {
+	if strings.EqualFold(pattern, host) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") || len(host) <= len(suffix) {
+		return false
+	}
+	label, rest := host[:len(host)-len(suffix)], host[len(host)-len(suffix):]
+	return strings.EqualFold(rest, suffix) && !strings.Contains(label, ".")
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	gitfs_guard <filesystem>
+func (g *Guard) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// consume the directive
+	d.Next()
+	if !d.Args(&g.Filesystem) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseGuard(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var g Guard
+	err := g.UnmarshalCaddyfile(h.Dispenser)
+	return g, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Guard)(nil)
+	_ caddyhttp.MiddlewareHandler = Guard{}
+	_ caddyfile.Unmarshaler       = (*Guard)(nil)
+)
@@ -0,0 +1,57 @@
+package gitfs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHostMatches(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "WWW.Example.COM", true},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "wwwexample.com", false},
+		{"*example.com", "wwwexample.com", false},
+	} {
+		if got := hostMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	r := &Repo{Name: "hosts", AllowedHosts: []string{"example.com", "*.example.net"}}
+	for _, tt := range []struct {
+		host string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"example.com:8443", true},
+		{"docs.example.net", true},
+		{"other.com", false},
+		{"[::1]:443", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		err := r.checkHost(req)
+		var he caddyhttp.HandlerError
+		if tt.ok != (err == nil) || (err != nil && (!errors.As(err, &he) || he.StatusCode != http.StatusNotFound)) {
+			t.Errorf("host %q: %v, want allowed: %v", tt.host, err, tt.ok)
+		}
+	}
+	if err := (&Repo{}).checkHost(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Errorf("without allowed_hosts: %v", err)
+	}
+}
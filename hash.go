@@ -0,0 +1,86 @@
+package gitfs
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(HashVars{})
+	httpcaddyfile.RegisterHandlerDirective("gitfs_hash", parseHashVars)
+}
+
+// HashVars is a middleware that exposes the commit hash served by a
+// named git filesystem to the rest of the route as the `gitfs_hash`
+// variable. It is available as the `{http.vars.gitfs_hash}` placeholder
+// and to templates as `{{placeholder "http.vars.gitfs_hash"}}`, making
+// it usable as a per-commit cache key. The hash is also added to the
+// access log of the request as the `gitfs_hash` field, correlating
+// requests with the deployed commit.
+type HashVars struct {
+	// The name of the git filesystem
+	Filesystem string `json:"filesystem,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (HashVars) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.gitfs_hash",
+		New: func() caddy.Module { return new(HashVars) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (h *HashVars) Provision(ctx caddy.Context) error {
+	if h.Filesystem == "" {
+		return fmt.Errorf("'filesystem' is empty")
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h HashVars) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// the filesystem is looked up on each request because it may be
+	// provisioned after this handler or replaced by a config reload
+	if repo, ok := lookupRepo(h.Filesystem); ok {
+		hash := repo.currentHash().String()
+		caddyhttp.SetVar(r.Context(), "gitfs_hash", hash)
+		if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+			extra.Add(zap.String("gitfs_hash", hash))
+		}
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	gitfs_hash <filesystem>
+func (h *HashVars) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// consume the directive
+	d.Next()
+	if !d.Args(&h.Filesystem) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseHashVars(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var hv HashVars
+	err := hv.UnmarshalCaddyfile(h.Dispenser)
+	return hv, err
+}
+
+var (
+	_ caddy.Provisioner           = (*HashVars)(nil)
+	_ caddyhttp.MiddlewareHandler = HashVars{}
+	_ caddyfile.Unmarshaler       = (*HashVars)(nil)
+)
@@ -0,0 +1,92 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A headerRule sets headers on the URL paths matching its pattern,
+// as read from a Netlify-style `_headers` file.
+type headerRule struct {
+	pattern string
+	header  http.Header
+}
+
+// parseHeadersFile parses a `_headers` file: each unindented line is a
+// path pattern, followed by indented `Name: value` lines for the
+// headers to set on matching paths. Lines starting with `#` are comments.
+// See https://docs.netlify.com/routing/headers/.
+func parseHeadersFile(data []byte) ([]headerRule, error) {
+	var rules []headerRule
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line == trimmed {
+			if !strings.HasPrefix(line, "/") {
+				return nil, fmt.Errorf("line %d: path pattern %q does not start with '/'", n, line)
+			}
+			rules = append(rules, headerRule{pattern: line, header: make(http.Header)})
+			continue
+		}
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("line %d: header before the first path pattern", n)
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected 'Name: value', got %q", n, trimmed)
+		}
+		rules[len(rules)-1].header.Add(name, strings.TrimSpace(value))
+	}
+	return rules, s.Err()
+}
+
+// matchPath reports whether the URL path p matches pattern. A `*` as the
+// last segment of the pattern matches the rest of the path, and a segment
+// starting with `:` matches any single non-empty segment.
+func matchPath(pattern, p string) bool {
+	segs := strings.Split(pattern, "/")
+	parts := strings.Split(p, "/")
+	for i, seg := range segs {
+		if seg == "*" && i == len(segs)-1 {
+			return true
+		}
+		if i >= len(parts) {
+			return false
+		}
+		if strings.HasPrefix(seg, ":") && parts[i] != "" {
+			continue
+		}
+		if seg != parts[i] {
+			return false
+		}
+	}
+	return len(segs) == len(parts)
+}
+
+// Headers returns the headers that the `headers_file` of the commit
+// currently served sets on the URL path p, combining the values of all
+// matching rules in file order. It returns nil if no rule matches, so
+// that a middleware can apply the rules on top of any file server.
+func (r *Repo) Headers(p string) http.Header {
+	var h http.Header
+	for _, rule := range r.current.Load().headers {
+		if !matchPath(rule.pattern, p) {
+			continue
+		}
+		if h == nil {
+			h = make(http.Header)
+		}
+		for name, values := range rule.header {
+			h[name] = append(h[name], values...)
+		}
+	}
+	return h
+}
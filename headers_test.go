@@ -0,0 +1,82 @@
+package gitfs
+
+import (
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseHeadersFile(t *testing.T) {
+	rules, err := parseHeadersFile([]byte(`# comment
+/assets/*
+	Cache-Control: public, max-age=31536000, immutable
+  X-Multi: a
+
+/blog/:slug
+	X-Robots-Tag: noindex
+	X-Multi: b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []headerRule{
+		{"/assets/*", http.Header{"Cache-Control": {"public, max-age=31536000, immutable"}, "X-Multi": {"a"}}},
+		{"/blog/:slug", http.Header{"X-Robots-Tag": {"noindex"}, "X-Multi": {"b"}}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+
+	for _, bad := range []string{
+		"assets/*\n\tX-A: b\n",
+		"\tX-A: b\n",
+		"/assets/*\n\tno colon\n",
+		"/assets/*\n\t: value\n",
+	} {
+		if _, err := parseHeadersFile([]byte(bad)); err == nil {
+			t.Errorf("%q: parsed without error", bad)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/", true},
+		{"/about", "/about", true},
+		{"/about", "/about/team", false},
+		{"/assets/*", "/assets/app.js", true},
+		{"/assets/*", "/assets/img/logo.png", true},
+		{"/assets/*", "/other/app.js", false},
+		{"/blog/:slug", "/blog/hello", true},
+		{"/blog/:slug", "/blog/", false},
+		{"/blog/:slug", "/blog/hello/more", false},
+		{"/*", "/anything/at/all", true},
+	} {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	rules, err := parseHeadersFile([]byte("/*\n\tX-Multi: all\n/blog/:slug\n\tX-Multi: blog\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Repo{current: &atomic.Pointer[snapshot]{}}
+	r.current.Store(&snapshot{headers: rules})
+	if got := r.Headers("/blog/hello")["X-Multi"]; !reflect.DeepEqual(got, []string{"all", "blog"}) {
+		t.Errorf("combined values %v, want them in file order", got)
+	}
+	if h := r.Headers("/"); h.Get("X-Multi") != "all" {
+		t.Errorf("headers of / = %v", h)
+	}
+	r.current.Store(&snapshot{})
+	if h := r.Headers("/"); h != nil {
+		t.Errorf("headers without rules = %v, want nil", h)
+	}
+}
@@ -0,0 +1,148 @@
+package gitfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(List{})
+	httpcaddyfile.RegisterHandlerDirective("gitfs_list", parseList)
+}
+
+// List is a handler responding with a JSON listing of the directory
+// at the request path in a named git filesystem, for frontends that
+// browse the content through an API. The listing is taken from a
+// single commit, whose hash is part of the response. Use it under
+// `handle_path` to serve it below a prefix.
+type List struct {
+	// The name of the git filesystem
+	Filesystem string `json:"filesystem,omitempty"`
+}
+
+// listing is the response of the List handler.
+type listing struct {
+	Hash    string         `json:"hash"`
+	Path    string         `json:"path"`
+	Entries []listingEntry `json:"entries"`
+}
+
+// listingEntry describes a directory entry. The hash of a file is
+// the object hash of its blob; directories have none.
+type listingEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	IsDir   bool      `json:"is_dir"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (List) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.gitfs_list",
+		New: func() caddy.Module { return new(List) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (l *List) Provision(ctx caddy.Context) error {
+	if l.Filesystem == "" {
+		return fmt.Errorf("'filesystem' is empty")
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (l List) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+	repo, ok := lookupRepo(l.Filesystem)
+	if !ok {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("unknown git filesystem %q", l.Filesystem))
+	}
+	if err := repo.checkHost(r); err != nil {
+		return err
+	}
+	dir := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+	if dir == "" {
+		dir = "."
+	}
+	snap := repo.current.Load()
+	if info, err := fs.Stat(snap.statFs, dir); err == nil && !info.IsDir() {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s is not a directory", dir))
+	}
+	entries, err := fs.ReadDir(snap.statFs, dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// the hashes of the blobs as committed, before any transformation;
+	// a file failing to hash is listed without one
+	index, _ := snap.blobIndex()
+	resp := listing{
+		Hash:    snap.hash.String(),
+		Path:    dir,
+		Entries: make([]listingEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		entry := listingEntry{
+			Name:    e.Name(),
+			Size:    info.Size(),
+			IsDir:   e.IsDir(),
+			ModTime: info.ModTime(),
+		}
+		if h, ok := index.byPath[path.Join(dir, e.Name())]; ok && !e.IsDir() {
+			entry.Hash = h.String()
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	gitfs_list <filesystem>
+func (l *List) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// consume the directive
+	d.Next()
+	if !d.Args(&l.Filesystem) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseList(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var l List
+	err := l.UnmarshalCaddyfile(h.Dispenser)
+	return l, err
+}
+
+var (
+	_ caddy.Provisioner           = (*List)(nil)
+	_ caddyhttp.MiddlewareHandler = List{}
+	_ caddyfile.Unmarshaler       = (*List)(nil)
+)
@@ -0,0 +1,49 @@
+package gitfs
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+func TestList(t *testing.T) {
+	tree := fstest.MapFS{
+		"dir/a.txt":   {Data: []byte("a")},
+		"dir/sub/b":   {Data: []byte("b")},
+		"top.txt":     {Data: []byte("top")},
+		"dir/dup.txt": {Data: []byte("top")},
+	}
+	r := &Repo{Name: "list", current: &atomic.Pointer[snapshot]{}}
+	r.current.Store(&snapshot{tree: tree, statFs: statFs{tree}})
+	registerRepo(r)
+	defer unregisterRepo(r)
+
+	w := httptest.NewRecorder()
+	if err := (List{Filesystem: "list"}).ServeHTTP(w, httptest.NewRequest("GET", "/dir/", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	var resp listing
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a.txt":   blobHash([]byte("a")).String(),
+		"dup.txt": blobHash([]byte("top")).String(),
+		"sub":     "",
+	}
+	if resp.Path != "dir" || len(resp.Entries) != len(want) {
+		t.Fatalf("listing = %+v", resp)
+	}
+	for _, e := range resp.Entries {
+		if h, ok := want[e.Name]; !ok || e.Hash != h || e.IsDir != (e.Name == "sub") {
+			t.Errorf("entry %+v, want hash %q", e, h)
+		}
+	}
+
+	err := (List{Filesystem: "list"}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/top.txt", nil), nil)
+	if err == nil {
+		t.Error("listed a file")
+	}
+}
@@ -0,0 +1,78 @@
+package gitfs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	_ "github.com/caddyserver/caddy/v2/modules/logging"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogLevel(t *testing.T) {
+	rem := newTestRemote(t, map[string]string{"index.html": "v1"})
+	dir := t.TempDir()
+	sink := func(name, level string, extra map[string]any) map[string]any {
+		log := map[string]any{
+			"writer": map[string]any{"output": "file", "filename": filepath.Join(dir, name)},
+			"level":  level,
+		}
+		for k, v := range extra {
+			log[k] = v
+		}
+		return log
+	}
+	cfg, err := json.Marshal(map[string]any{
+		"admin": map[string]any{"disabled": true},
+		"logging": map[string]any{"logs": map[string]any{
+			"default":  sink("errors.log", "ERROR", nil),
+			"kept":     sink("kept.log", "DEBUG", nil),
+			"excluded": sink("excluded.log", "DEBUG", map[string]any{"exclude": []string{"caddy.fs.git"}}),
+		}},
+		"apps": map[string]any{"gitfs_test": map[string]any{"filesystems": []map[string]any{
+			{"name": "info", "url": rem.URL, "log_level": "info"},
+			{"name": "quiet", "url": rem.URL, "log_level": "error"},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	if err := caddy.Load(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	info, _ := lookupRepo("info")
+	quiet, _ := lookupRepo("quiet")
+	if info.logger.Check(zapcore.DebugLevel, "debug") != nil {
+		t.Error("debug logs enabled with log_level info")
+	}
+	if quiet.logger.Check(zapcore.InfoLevel, "info") != nil {
+		t.Error("info logs enabled with log_level error")
+	}
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	kept := read("kept.log")
+	if !strings.Contains(kept, `"filesystem":"info"`) {
+		t.Errorf("the clone of the filesystem at log_level info was not logged:\n%s", kept)
+	}
+	if strings.Contains(kept, `"filesystem":"quiet"`) {
+		t.Errorf("the filesystem at log_level error logged below it:\n%s", kept)
+	}
+	// log_level must not bypass the level and filters of each log
+	if errors := read("errors.log"); strings.Contains(errors, `"filesystem"`) {
+		t.Errorf("a log at ERROR received entries below it:\n%s", errors)
+	}
+	if excluded := read("excluded.log"); strings.Contains(excluded, `"filesystem"`) {
+		t.Errorf("a log excluding the filesystems received their entries:\n%s", excluded)
+	}
+}
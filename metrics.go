@@ -0,0 +1,48 @@
+package gitfs
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var gitfsMetrics = struct {
+	init    sync.Once
+	lookups *prometheus.CounterVec
+	misses  *prometheus.CounterVec
+	objects *prometheus.GaugeVec
+	size    *prometheus.GaugeVec
+}{
+	init: sync.Once{},
+}
+
+func initGitfsMetrics() {
+	const ns, sub = "caddy", "gitfs"
+
+	labels := []string{"filesystem"}
+	gitfsMetrics.lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lookups_total",
+		Help:      "Counter of Open and Stat calls on git filesystems.",
+	}, labels)
+	gitfsMetrics.misses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lookup_misses_total",
+		Help:      "Counter of Open and Stat calls on git filesystems that found nothing.",
+	}, labels)
+	gitfsMetrics.objects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "objects",
+		Help:      "Number of trees and blobs in the commit served by git filesystems.",
+	}, labels)
+	gitfsMetrics.size = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "size_bytes",
+		Help:      "Total size of the blobs in the commit served by git filesystems.",
+	}, labels)
+}
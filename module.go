@@ -1,17 +1,31 @@
 package gitfs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"math/rand"
 	"net/url"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding"
 	"rsc.io/gitfs"
 )
 
@@ -19,26 +33,248 @@ func init() {
 	caddy.RegisterModule(Repo{})
 }
 
+const (
+	// refAuto is the `ref` value requesting the default branch.
+	refAuto = "auto"
+
+	defaultCircuitBackoff = 10 * time.Minute
+)
+
+// The `on_ref_deleted` policies.
+const (
+	refDeletedKeepLast = "keep_last"
+	refDeletedError    = "error"
+	refDeletedFallback = "fallback_ref"
+)
+
+// errRefDeleted is the error lookups fail with once `ref` was
+// deleted under the `error` policy of `on_ref_deleted`.
+var errRefDeleted = errors.New("the ref was deleted from the remote")
+
+// errStale is the error lookups fail with while the content is stale
+// and a `maintenance_file` is set.
+var errStale = errors.New("the content is out of date; try again later")
+
+// errNothingStaged is returned when promoting while no commit
+// awaits promotion.
+var errNothingStaged = errors.New("no commit is staged for promotion")
+
 // The `git` filesystem module uses a git repository as the
 // virtual filesystem.
 type Repo struct {
-	// The URL of the git repository
+	// The URL of the git repository. Credentials may be given in its
+	// userinfo, with placeholders such as `{env.GIT_TOKEN}`,
+	// `{file.<path>}` or `{storage.<key>}` to keep them out of the
+	// config.
 	URL string `json:"url,omitempty"`
 
+	// Other URLs of the same repository, tried in order when the
+	// remote at `url` cannot be reached, at provision and on every
+	// refresh. While a mirror is used, every refresh tries the URLs
+	// before it again, so the primary is used once it is back. The
+	// placeholders and `auth` apply to them like to `url`.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// The hosts allowed to serve this filesystem, e.g. `example.com`
+	// or `*.example.com`. The filesystem cannot see requests, so this
+	// is enforced by the gitfs handlers and the `gitfs_guard`
+	// middleware, which refuse other hosts with status 404.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// The credentials to authenticate to the remote with, as an
+	// alternative to the URL userinfo.
+	Auth *Auth `json:"auth,omitempty"`
+
+	// The name by which the admin API refers to this filesystem,
+	// also reported in its logs, events and metrics labels. The key
+	// the filesystem is registered under is not passed to the module,
+	// so it is usually repeated here. Filesystems without a name are
+	// not exposed to the admin API.
+	Name string `json:"name,omitempty"`
+
 	// The reference to clone the repository at.
-	// An empty value means HEAD.
+	// An empty value means HEAD, which every refresh resolves
+	// again, so the content switches branches when the default
+	// branch of the remote changes. The value `auto` looks up the
+	// branch the remote HEAD points at once, at provision, and
+	// keeps following that branch.
 	Ref string `json:"ref,omitempty"`
 
 	// The period between ref refreshes
 	RefreshPeriod caddy.Duration `json:"refresh_period,omitempty"`
 
-	statFs statFs
-	mu     *sync.RWMutex
-	repo   *gitfs.Repo
-	hash   gitfs.Hash
+	// The maximum time provisioning waits for the initial clone,
+	// including the lookup of the default branch for the `auto` ref,
+	// to complete before failing. An empty value waits indefinitely.
+	ReadyTimeout caddy.Duration `json:"ready_timeout,omitempty"`
+
+	// The time to wait before the initial clone, useful to
+	// stagger many instances booting at once. The delay only applies
+	// once per process, when Caddy starts: config reloads do not wait.
+	StartupDelay caddy.Duration `json:"startup_delay,omitempty"`
+
+	// The upper bound of a random duration added to `startup_delay`.
+	StartupJitter caddy.Duration `json:"startup_jitter,omitempty"`
+
+	// The number of consecutive refresh failures after which the
+	// circuit opens and refreshes back off to `circuit_backoff`.
+	// An empty value disables the circuit breaker.
+	CircuitThreshold int `json:"circuit_threshold,omitempty"`
+
+	// The period between probes of the remote while the circuit is
+	// open. Default: 10m
+	CircuitBackoff caddy.Duration `json:"circuit_backoff,omitempty"`
+
+	// The commit hash `ref` must resolve to for its content to be
+	// served, to gate a moving ref on a reviewed commit. When a
+	// refresh finds the ref elsewhere, the current content is kept
+	// and the other commit is reported as `refused` in the state of
+	// the admin API; this does not count as a failed refresh.
+	ExpectedHash string `json:"expected_hash,omitempty"`
+
+	// What to do once `ref` is deleted from the remote: `keep_last`
+	// keeps serving the last commit while reporting unhealthy, `error`
+	// fails every lookup until the ref is back, and `fallback_ref`
+	// follows `fallback_ref` instead. Default: `keep_last`
+	OnRefDeleted string `json:"on_ref_deleted,omitempty"`
+
+	// The ref to follow while `ref` is deleted, for the `fallback_ref`
+	// policy of `on_ref_deleted`.
+	FallbackRef string `json:"fallback_ref,omitempty"`
+
+	// Serve an empty tree when the repository has no commits yet,
+	// instead of failing provisioning, and pick up the first push on
+	// refresh. The `auto` ref cannot be used with empty repositories.
+	AllowEmpty bool `json:"allow_empty,omitempty"`
+
+	// The path, relative to the repository root, of a marker file such
+	// as `RELEASE` gating refreshes: a new commit is only served if the
+	// content of this file differs from that of the served commit, so
+	// other commits are skipped even though the ref moved.
+	Sentinel string `json:"sentinel,omitempty"`
+
+	// Stage the commits found by refreshes instead of serving them,
+	// until they are promoted through the admin API. The initial
+	// clone is served right away.
+	ManualPromote bool `json:"manual_promote,omitempty"`
+
+	// The filesystem module to serve paths missing from the
+	// repository, e.g. another `git` filesystem during a migration.
+	FallthroughRaw json.RawMessage `json:"fallthrough,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// The number of leading directories to strip from the tree, like
+	// `tar --strip-components`, for repositories wrapping their content
+	// in a top-level directory. Every stripped level must hold a single
+	// directory, whose files are not served, and the other paths of the
+	// config are relative to the directory it leads to.
+	StripComponents int `json:"strip_components,omitempty"`
+
+	// The path, relative to the repository root, of a Netlify-style
+	// `_headers` file to parse after every clone. The parsed rules are
+	// available to other modules through the Headers method.
+	HeadersFile string `json:"headers_file,omitempty"`
+
+	// Paths to serve the content of other paths at, keyed by the path
+	// requested. A directory alias also applies to everything under it,
+	// e.g. `latest` to `v3.2`. Unlike a redirect, the requested URL stays
+	// the same. Aliases are resolved against the commit being served, and
+	// a target missing from a new commit is logged.
+	Alias map[string]string `json:"alias,omitempty"`
+
+	// The file names that opening a directory returns instead, the
+	// first one present winning. Stat still reports the directory.
+	// The file server lists directories and looks up index files
+	// itself, so this is for other consumers of the filesystem.
+	DirectoryIndex []string `json:"directory_index,omitempty"`
+
+	// The size in bytes above which files are not served, as if
+	// they were not in the repository.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// The extensions, including the leading dot, of the only files
+	// served, e.g. `.html` and `.css`. Other files are not served, as
+	// if they were not in the repository. An empty list serves all.
+	AllowExtensions []string `json:"allow_extensions,omitempty"`
+
+	// Transcodes files committed in a legacy character set to UTF-8.
+	Charset *Charset `json:"charset,omitempty"`
+
+	// Normalizes line endings and strips the BOM of text files.
+	TextNormalize *TextNormalize `json:"text_normalize,omitempty"`
+
+	// How long refreshes must have been failing in a row for the
+	// served content to be considered stale, measured from the first
+	// failure since the last success. Staleness is only tracked when
+	// `refresh_period` is set.
+	StaleThreshold caddy.Duration `json:"stale_threshold,omitempty"`
+
+	// The path of a local maintenance page to render while the content
+	// is stale. Every lookup then fails with status 503, so that
+	// `handle_errors` can serve this file; the filesystem only checks
+	// that it exists. Requires `stale_threshold`.
+	MaintenanceFile string `json:"maintenance_file,omitempty"`
+
+	// Read every object of a new clone before serving it, so that an
+	// incomplete or corrupted transfer keeps the previous commit served
+	// and the filesystem unhealthy instead of failing lookups later.
+	Verify bool `json:"verify,omitempty"`
+
+	// Compute the files changed between the served commit and the
+	// new one on every refresh, for the `gitfs_refreshed` event and
+	// the stats of the admin API. Both trees are walked and hashed,
+	// which adds to the cost of every refresh cloning a new commit.
+	DiffChanges bool `json:"diff_changes,omitempty"`
+
+	// The level of the logs of this filesystem, one of `debug`,
+	// `info`, `warn` or `error`, so that one filesystem can stay quiet
+	// while others are debugged. It can only raise the level of the
+	// Caddy logs: to debug one filesystem, set a log to DEBUG and
+	// raise the level of the others. The entries still go through the
+	// level, filters and sampling of every log, and carry the `name`
+	// as the `filesystem` field.
+	LogLevel string `json:"log_level,omitempty"`
+
+	current      *atomic.Pointer[snapshot]
+	remote       *atomic.Pointer[remote]
+	expectedHash gitfs.Hash
+	charset      encoding.Encoding
+	// whether `fallback_ref` is followed in place of the deleted `ref`
+	fallback *atomic.Bool
+	// the commit awaiting promotion in `manual_promote` mode
+	staged *atomic.Pointer[snapshot]
+	// the commit `ref` last resolved to in place of `expected_hash`,
+	// kept from being served
+	refused       *atomic.Pointer[gitfs.Hash]
+	fallthroughFS fs.FS
+	// serializes the refresh loop with the pulls and promotions of
+	// the admin API
+	pullMu *sync.Mutex
+	// the last commit skipped for an unchanged `sentinel`, guarded
+	// by pullMu
+	sentinelSkipped gitfs.Hash
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// unix nanoseconds of the last successful refresh
+	refreshed *atomic.Int64
+	// the error of the last refresh, if it failed
+	refreshErr *atomic.Pointer[error]
+	// the first of the refreshes failing in a row, nil once one succeeds
+	failing *atomic.Pointer[refreshFailure]
+	// the number of refreshes failing in a row
+	failures *atomic.Int64
+	// whether the circuit breaker is open, switched by the refresh loop
+	circuitOpen *atomic.Bool
+
+	caddyCtx caddy.Context
+	events   *caddyevents.App
+
+	lookups prometheus.Counter
+	misses  prometheus.Counter
+	objects prometheus.Gauge
+	size    prometheus.Gauge
+
 	logger *zap.Logger
 }
 
@@ -58,28 +294,120 @@ func (Repo) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (r *Repo) Provision(ctx caddy.Context) (err error) {
 	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.caddyCtx = ctx
 	r.logger = ctx.Logger()
-	if r.URL == "" {
-		return fmt.Errorf("'url' is empty")
+	if r.Name != "" {
+		r.logger = r.logger.With(zap.String("filesystem", r.Name))
+	}
+	if r.LogLevel != "" {
+		level, err := zapcore.ParseLevel(r.LogLevel)
+		if err != nil {
+			return fmt.Errorf("'log_level': %v", err)
+		}
+		if r.logger.Core().Enabled(level) {
+			r.logger = r.logger.WithOptions(zap.IncreaseLevel(level))
+		} else {
+			r.logger.Warn("'log_level' is below the level of every log; it can only make the logs of the filesystem quieter",
+				zap.String("log_level", r.LogLevel),
+			)
+		}
+	}
+	eventsAppIface, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
 	}
-	r.repo, err = gitfs.NewRepo(r.URL)
+	r.events = eventsAppIface.(*caddyevents.App)
+	gitfsMetrics.init.Do(initGitfsMetrics)
+	r.lookups = gitfsMetrics.lookups.WithLabelValues(r.Name)
+	r.misses = gitfsMetrics.misses.WithLabelValues(r.Name)
+	r.objects = gitfsMetrics.objects.WithLabelValues(r.Name)
+	r.size = gitfsMetrics.size.WithLabelValues(r.Name)
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if err := checkNameUnique(r); err != nil {
+		return err
+	}
+	if r.Auth != nil {
+		if err := r.Auth.provision(ctx); err != nil {
+			return fmt.Errorf("'auth': %v", err)
+		}
+	}
+	remoteURL, err := r.credentialURL(0)
 	if err != nil {
 		return err
 	}
+	r.remote = &atomic.Pointer[remote]{}
+	r.remote.Store(&remote{url: remoteURL})
 	if r.Ref == "" {
 		r.Ref = "HEAD"
 	}
-	h, fs, err := r.repo.Clone(r.Ref)
-	if err != nil {
+	if r.ExpectedHash != "" {
+		r.expectedHash, _ = parseHash(r.ExpectedHash)
+	}
+	if r.Charset != nil {
+		r.charset, _ = r.Charset.encoding()
+	}
+	if r.FallthroughRaw != nil {
+		mod, err := ctx.LoadModule(r, "FallthroughRaw")
+		if err != nil {
+			return fmt.Errorf("loading fallthrough filesystem: %v", err)
+		}
+		fsys, ok := mod.(fs.FS)
+		if !ok {
+			return fmt.Errorf("fallthrough module %T is not a file system implementation (requires fs.FS)", mod)
+		}
+		r.fallthroughFS = fsys
+	}
+	if r.MaintenanceFile != "" {
+		if _, err := os.Stat(r.MaintenanceFile); err != nil {
+			return fmt.Errorf("reading maintenance file: %v", err)
+		}
+	}
+	if err := r.waitStartupDelay(); err != nil {
 		return err
 	}
-	r.hash = h
-	r.statFs = statFs{fs}
-	r.mu = &sync.RWMutex{}
+	rem, h, fs, err := r.initialClone()
+	if rem != nil {
+		r.remote.Store(rem)
+	}
+	if err == nil {
+		err = r.checkExpectedHash(h)
+	}
+	if err != nil && rem != nil && r.remoteEmpty() {
+		if !r.AllowEmpty {
+			return fmt.Errorf("the repository is empty; set 'allow_empty' to serve it before the first push")
+		}
+		r.logger.Warn("the repository is empty; serving no files until the first push")
+		fs, err = emptyFS{}, nil
+	}
+	if err != nil {
+		return describeUnknownRef(r.remote.Load().url, r.Ref, err)
+	}
+	r.current = &atomic.Pointer[snapshot]{}
+	r.staged = &atomic.Pointer[snapshot]{}
+	r.refused = &atomic.Pointer[gitfs.Hash]{}
+	r.fallback = &atomic.Bool{}
+	r.pullMu = &sync.Mutex{}
+	snap := r.newSnapshot(h, fs)
+	r.serve(snap)
+	r.logger.Info("cloned `ref`",
+		zap.String("ref", r.Ref),
+		zap.String("hash", h.String()),
+		zap.Int("objects", snap.objects),
+		zap.Int64("size", snap.size),
+	)
+	r.refreshed = &atomic.Int64{}
+	r.refreshed.Store(time.Now().UnixNano())
+	r.refreshErr = &atomic.Pointer[error]{}
+	r.failing = &atomic.Pointer[refreshFailure]{}
+	r.failures = &atomic.Int64{}
+	r.circuitOpen = &atomic.Bool{}
+	registerRepo(r)
 	if r.RefreshPeriod != 0 {
 		r.logger.Info("starting `ref` hash refresh",
 			zap.String("ref", r.Ref),
-			zap.String("hash", r.hash.String()),
+			zap.String("hash", h.String()),
 			zap.Duration("period", time.Duration(r.RefreshPeriod)),
 		)
 		go r.refresh()
@@ -87,24 +415,678 @@ func (r *Repo) Provision(ctx caddy.Context) (err error) {
 	return nil
 }
 
+// A remote is a connection to the repository with a set of
+// credentials. It is replaced as a whole when the credentials are
+// reloaded.
+type remote struct {
+	// the URL with its placeholders replaced and `auth` applied
+	url string
+	// the index of the URL in `url` and `mirrors`, 0 being `url`
+	mirror int
+	repo   *gitfs.Repo
+}
+
+// credentialURL returns `url`, or the `mirrors` entry before the
+// given index if it is not 0, with its placeholders replaced and the
+// `auth` credentials applied.
+func (r *Repo) credentialURL(mirror int) (string, error) {
+	raw, field := r.URL, "url"
+	if mirror > 0 {
+		raw, field = r.Mirrors[mirror-1], fmt.Sprintf("mirror %d", mirror)
+	}
+	u, err := resolveSecret(r.caddyCtx, raw)
+	if err != nil {
+		return "", fmt.Errorf("resolving '%s': %v", field, err)
+	}
+	if r.Auth != nil {
+		u, err = r.Auth.apply(r.caddyCtx, u)
+		if err != nil {
+			return "", fmt.Errorf("applying 'auth': %v", err)
+		}
+	}
+	return u, nil
+}
+
+// reloadAuth resolves the credentials again, re-reading the files
+// and storage they are loaded from, and connects to the remote with
+// them. The current connection is kept if the remote rejects them.
+func (r *Repo) reloadAuth() error {
+	// a concurrent pull could otherwise switch mirrors or renew the
+	// old credentials over the reloaded ones
+	r.pullMu.Lock()
+	defer r.pullMu.Unlock()
+	mirror := r.remote.Load().mirror
+	u, err := r.credentialURL(mirror)
+	if err != nil {
+		return err
+	}
+	if err := r.connect(mirror, u); err != nil {
+		return fmt.Errorf("connecting with the reloaded credentials: %v", err)
+	}
+	r.logger.Info("reloaded credentials")
+	return nil
+}
+
+// renewAuth queries the token source of `auth` before a refresh and
+// reconnects to the remote if the credentials changed.
+func (r *Repo) renewAuth() error {
+	rem := r.remote.Load()
+	u, err := r.credentialURL(rem.mirror)
+	if err != nil {
+		return fmt.Errorf("renewing credentials: %v", err)
+	}
+	if u == rem.url {
+		return nil
+	}
+	if err := r.connect(rem.mirror, u); err != nil {
+		return fmt.Errorf("connecting with the renewed credentials: %v", err)
+	}
+	r.logger.Debug("renewed credentials")
+	return nil
+}
+
+// connect connects to the remote at the credential URL u of the
+// given mirror and uses that connection from then on.
+func (r *Repo) connect(mirror int, u string) error {
+	repo, err := gitfs.NewRepo(u)
+	if err != nil {
+		return err
+	}
+	r.remote.Store(&remote{url: u, repo: repo, mirror: mirror})
+	return nil
+}
+
+// dial connects to the first reachable of `url` and `mirrors`, in
+// that order.
+func (r *Repo) dial() (*remote, error) {
+	var errs []error
+	for mirror := 0; mirror <= len(r.Mirrors); mirror++ {
+		u, err := r.credentialURL(mirror)
+		if err == nil {
+			var repo *gitfs.Repo
+			if repo, err = gitfs.NewRepo(u); err == nil {
+				return &remote{url: u, repo: repo, mirror: mirror}, nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// defaultBranch returns the branch the remote HEAD points at, asking
+// `url` and `mirrors` in order until one answers.
+func (r *Repo) defaultBranch() (string, error) {
+	var errs []error
+	for mirror := 0; mirror <= len(r.Mirrors); mirror++ {
+		u, err := r.credentialURL(mirror)
+		if err == nil {
+			var branch string
+			if branch, err = defaultBranch(u); err == nil {
+				return branch, nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// remoteURL returns the configured URL of the given mirror, as
+// written in the config.
+func (r *Repo) remoteURL(mirror int) string {
+	if mirror > 0 {
+		return r.Mirrors[mirror-1]
+	}
+	return r.URL
+}
+
+// validate checks the configuration for errors that do not
+// need contacting the remote.
+func (r *Repo) validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("'url' is empty")
+	}
+	if err := validateRef(r.Ref); err != nil {
+		return err
+	}
+	if r.Auth != nil {
+		if err := r.Auth.validate(); err != nil {
+			return fmt.Errorf("'auth': %v", err)
+		}
+	}
+	if r.ExpectedHash != "" {
+		if _, err := parseHash(r.ExpectedHash); err != nil {
+			return fmt.Errorf("'expected_hash': %v", err)
+		}
+	}
+	switch r.OnRefDeleted {
+	case "", refDeletedKeepLast, refDeletedError:
+		if r.FallbackRef != "" {
+			return fmt.Errorf("'fallback_ref' requires the 'fallback_ref' policy of 'on_ref_deleted'")
+		}
+	case refDeletedFallback:
+		if r.FallbackRef == "" || r.FallbackRef == refAuto {
+			return fmt.Errorf("'on_ref_deleted' %s requires a 'fallback_ref'", refDeletedFallback)
+		}
+		if err := validateRef(r.FallbackRef); err != nil {
+			return fmt.Errorf("'fallback_ref': %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown 'on_ref_deleted' policy %q", r.OnRefDeleted)
+	}
+	if r.LogLevel != "" {
+		if _, err := zapcore.ParseLevel(r.LogLevel); err != nil {
+			return fmt.Errorf("'log_level': %v", err)
+		}
+	}
+	if r.RefreshPeriod < 0 {
+		return fmt.Errorf("'refresh_period' is negative")
+	}
+	if r.ReadyTimeout < 0 {
+		return fmt.Errorf("'ready_timeout' is negative")
+	}
+	if r.MaintenanceFile != "" && r.StaleThreshold <= 0 {
+		return fmt.Errorf("'maintenance_file' requires 'stale_threshold'")
+	}
+	if r.MaxFileSize < 0 {
+		return fmt.Errorf("'max_file_size' is negative")
+	}
+	if r.CircuitThreshold < 0 {
+		return fmt.Errorf("'circuit_threshold' is negative")
+	}
+	if r.CircuitBackoff < 0 {
+		return fmt.Errorf("'circuit_backoff' is negative")
+	}
+	if r.StripComponents < 0 {
+		return fmt.Errorf("'strip_components' is negative")
+	}
+	if r.Charset != nil {
+		if _, err := r.Charset.encoding(); err != nil {
+			return fmt.Errorf("'charset': %v", err)
+		}
+		if len(r.Charset.Files) == 0 {
+			return fmt.Errorf("'charset' has no files")
+		}
+		for _, g := range r.Charset.Files {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("'charset' file pattern %q: %v", g, err)
+			}
+		}
+	}
+	if r.TextNormalize != nil && len(r.TextNormalize.Extensions) == 0 {
+		return fmt.Errorf("'text_normalize' has no extensions")
+	}
+	for from, to := range r.Alias {
+		if !fs.ValidPath(from) || !fs.ValidPath(to) || from == "." {
+			return fmt.Errorf("'alias' %q to %q: not valid paths within the repository", from, to)
+		}
+	}
+	for _, index := range r.DirectoryIndex {
+		if !fs.ValidPath(index) || index == "." {
+			return fmt.Errorf("'directory_index' %q is not a valid file name", index)
+		}
+	}
+	for _, ext := range r.AllowExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("'allow_extensions' %q does not start with '.'", ext)
+		}
+	}
+	for i, m := range r.Mirrors {
+		if m == "" {
+			return fmt.Errorf("mirror %d is empty", i+1)
+		}
+	}
+	if r.Sentinel != "" && !fs.ValidPath(r.Sentinel) {
+		return fmt.Errorf("'sentinel' %q is not a valid path within the repository", r.Sentinel)
+	}
+	if r.HeadersFile != "" && !fs.ValidPath(r.HeadersFile) {
+		return fmt.Errorf("'headers_file' %q is not a valid path within the repository", r.HeadersFile)
+	}
+	return nil
+}
+
+// validateRef checks that ref is one of the forms rsc.io/gitfs can
+// resolve. Short names are rejected rather than left to fail as an
+// unknown ref once the remote is contacted.
+func validateRef(ref string) error {
+	switch {
+	case ref == "", ref == "HEAD", ref == refAuto:
+		return nil
+	case strings.HasPrefix(ref, "refs/") && len(ref) > len("refs/"):
+		return nil
+	}
+	if _, err := parseHash(ref); err == nil {
+		return nil
+	}
+	return fmt.Errorf("'ref' %q must be HEAD, auto, a full ref name such as refs/heads/main, or a 40-character commit hash", ref)
+}
+
+// LoadRepos decodes a JSON array of `caddy.fs.git` module configs and
+// validates each, for automation managing many git filesystems
+// programmatically. The repos are not provisioned; that happens when
+// they are loaded as part of a Caddy config.
+func LoadRepos(data []byte) ([]*Repo, error) {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return nil, err
+	}
+	repos := make([]*Repo, 0, len(raws))
+	names := make(map[string]int)
+	for i, raw := range raws {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		// accept the module's inline key as it appears in the
+		// `file_system` of a file server
+		cfg := struct {
+			Backend string `json:"backend,omitempty"`
+			*Repo
+		}{Repo: new(Repo)}
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("repo %d: %v", i, err)
+		}
+		if cfg.Backend != "" && cfg.Backend != "git" {
+			return nil, fmt.Errorf("repo %d: unexpected backend %q", i, cfg.Backend)
+		}
+		r := cfg.Repo
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("repo %d: %v", i, err)
+		}
+		if r.Name != "" {
+			if j, ok := names[r.Name]; ok {
+				return nil, fmt.Errorf("repo %d: name %q already used by repo %d", i, r.Name, j)
+			}
+			names[r.Name] = i
+		}
+		repos = append(repos, r)
+	}
+	return repos, nil
+}
+
+// startupDelayed is set once a filesystem of the process waited for
+// its `startup_delay`.
+var startupDelayed atomic.Bool
+
+// waitStartupDelay sleeps for `startup_delay` plus a random
+// portion of `startup_jitter` before the initial clone. Only the
+// first filesystem with a delay waits, so that config reloads and
+// the other filesystems, provisioned one after another, do not add
+// up delays.
+func (r *Repo) waitStartupDelay() error {
+	delay := time.Duration(r.StartupDelay)
+	if r.StartupJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(r.StartupJitter)))
+	}
+	if delay <= 0 || !startupDelayed.CompareAndSwap(false, true) {
+		return nil
+	}
+	r.logger.Info("delaying initial clone", zap.Duration("delay", delay))
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// initialClone connects to the repository and clones `ref`, giving up
+// once ReadyTimeout elapses. The remote connected to is returned even
+// if the clone fails.
+func (r *Repo) initialClone() (*remote, gitfs.Hash, fs.FS, error) {
+	type result struct {
+		ref    string
+		remote *remote
+		hash   gitfs.Hash
+		fs     fs.FS
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// `ready_timeout` covers the lookup of the default branch too
+		ref := r.Ref
+		if ref == refAuto {
+			branch, err := r.defaultBranch()
+			if err != nil {
+				done <- result{err: fmt.Errorf("detecting the default branch: %v", err)}
+				return
+			}
+			r.logger.Info("detected the default branch", zap.String("ref", branch))
+			ref = branch
+		}
+		rem, err := r.dial()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		if rem.mirror > 0 {
+			r.logger.Warn("remote unreachable; cloning from a mirror",
+				zap.String("mirror", redactURL(r.remoteURL(rem.mirror))),
+			)
+		}
+		h, f, err := rem.repo.Clone(ref)
+		if err == nil {
+			f, err = r.strip(h, f)
+		}
+		if err == nil && r.Verify {
+			if err = verifyTree(f); err != nil {
+				err = fmt.Errorf("verifying the clone of %s: %v", h, err)
+			}
+		}
+		done <- result{ref, rem, h, f, err}
+	}()
+
+	var timeout <-chan time.Time
+	if r.ReadyTimeout > 0 {
+		t := time.NewTimer(time.Duration(r.ReadyTimeout))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case res := <-done:
+		if res.ref != "" {
+			r.Ref = res.ref
+		}
+		return res.remote, res.hash, res.fs, res.err
+	case <-timeout:
+		return nil, gitfs.Hash{}, nil, fmt.Errorf("initial clone of `ref` %s did not complete within %s", r.Ref, time.Duration(r.ReadyTimeout))
+	case <-r.ctx.Done():
+		return nil, gitfs.Hash{}, nil, r.ctx.Err()
+	}
+}
+
+// A snapshot is the served state of a single commit. Snapshots are
+// never modified once published, apart from their blob index being
+// computed on first use, so readers holding one are not affected by a
+// refresh swapping in the next.
+type snapshot struct {
+	hash    gitfs.Hash
+	tree    fs.FS  // the tree as cloned
+	statFs  statFs // the tree with the configured transformations
+	headers []headerRule
+	objects int   // the number of trees and blobs
+	size    int64 // the total size of the blobs
+	// the files changed since the previous commit, with `diff_changes`
+	changes []pathChange
+
+	// the blob hash of every file of tree, computed on first use
+	blobsOnce sync.Once
+	blobs     blobIndex
+	blobsErr  error
+}
+
+// blobIndex returns the blob hash of every file of the tree of s, so
+// that looking blobs up by hash or by path does not read and hash the
+// whole tree every time. On error, the index holds the files hashed
+// before it.
+func (s *snapshot) blobIndex() (blobIndex, error) {
+	s.blobsOnce.Do(func() {
+		s.blobs, s.blobsErr = indexBlobs(s.tree)
+	})
+	return s.blobs, s.blobsErr
+}
+
+// newSnapshot prepares the tree of a freshly cloned commit for
+// serving, applying the configured transformations.
+func (r *Repo) newSnapshot(h gitfs.Hash, tree fs.FS) *snapshot {
+	served := tree
+	if r.MaxFileSize > 0 {
+		served = sizeLimitFS{served, r.MaxFileSize}
+	}
+	if len(r.AllowExtensions) > 0 {
+		served = extensionFS{served, r.AllowExtensions}
+	}
+	if r.charset != nil {
+		served = charsetFS{served, r.charset, r.Charset.Files}
+	}
+	if r.TextNormalize != nil {
+		served = textFS{served, r.TextNormalize}
+	}
+	snap := &snapshot{hash: h, tree: tree, statFs: statFs{served}}
+	if r.HeadersFile != "" {
+		snap.headers = r.loadHeadersFile(h, tree)
+	}
+	for from, to := range r.Alias {
+		if _, err := fs.Stat(snap.statFs, to); err != nil {
+			r.logger.Warn("alias target not found; the alias serves nothing",
+				zap.String("hash", h.String()),
+				zap.String("alias", from),
+				zap.String("target", to),
+				zap.Error(err),
+			)
+		}
+	}
+	var err error
+	snap.objects, snap.size, err = walkStats(tree)
+	if err != nil {
+		r.logger.Error("error computing tree size", zap.String("hash", h.String()), zap.Error(err))
+	}
+	return snap
+}
+
+// strip returns the directory `strip_components` levels below the
+// root of the tree of commit h.
+func (r *Repo) strip(h gitfs.Hash, tree fs.FS) (fs.FS, error) {
+	if r.StripComponents == 0 {
+		return tree, nil
+	}
+	sub, err := stripComponents(tree, r.StripComponents)
+	if err != nil {
+		return nil, fmt.Errorf("stripping the tree of %s: %v", h, err)
+	}
+	return sub, nil
+}
+
+// serve publishes snap as the served snapshot, returning the
+// previous one.
+func (r *Repo) serve(snap *snapshot) *snapshot {
+	old := r.current.Swap(snap)
+	r.objects.Set(float64(snap.objects))
+	r.size.Set(float64(snap.size))
+	return old
+}
+
+// loadHeadersFile parses the `headers_file` of the tree. A missing or
+// malformed file is logged and results in no rules, as it should not
+// keep the commit from being served.
+func (r *Repo) loadHeadersFile(h gitfs.Hash, tree fs.FS) []headerRule {
+	data, err := fs.ReadFile(tree, r.HeadersFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		r.logger.Debug("headers file not found", zap.String("hash", h.String()))
+		return nil
+	}
+	if err == nil {
+		var rules []headerRule
+		if rules, err = parseHeadersFile(data); err == nil {
+			return rules
+		}
+	}
+	r.logger.Error("error loading headers file",
+		zap.String("hash", h.String()),
+		zap.String("path", r.HeadersFile),
+		zap.Error(err),
+	)
+	return nil
+}
+
+// currentHash returns the hash of the commit currently served.
+func (r *Repo) currentHash() gitfs.Hash {
+	return r.current.Load().hash
+}
+
+// A refreshFailure records the first of the refreshes failing in a
+// row, with the ID its error was logged with.
+type refreshFailure struct {
+	since time.Time
+	id    string
+}
+
+// recordRefresh records the outcome of a refresh, returning the first
+// failure of the current run of failures, or nil if err is nil.
+func (r *Repo) recordRefresh(err error) *refreshFailure {
+	if err == nil {
+		r.refreshed.Store(time.Now().UnixNano())
+		r.refreshErr.Store(nil)
+		r.failing.Store(nil)
+		r.failures.Store(0)
+		return nil
+	}
+	r.refreshErr.Store(&err)
+	r.failures.Add(1)
+	r.failing.CompareAndSwap(nil, &refreshFailure{since: time.Now(), id: errorID()})
+	return r.failing.Load()
+}
+
+// stale reports whether refreshes have been failing for longer than
+// `stale_threshold`.
+func (r *Repo) stale() bool {
+	return r.staleFailure() != nil
+}
+
+// staleFailure returns the first of the refreshes failing in a row if
+// they have been failing for longer than `stale_threshold`.
+func (r *Repo) staleFailure() *refreshFailure {
+	if r.StaleThreshold <= 0 || r.RefreshPeriod == 0 {
+		return nil
+	}
+	f := r.failing.Load()
+	if f == nil || time.Since(f.since) <= time.Duration(r.StaleThreshold) {
+		return nil
+	}
+	return f
+}
+
+// maintenanceError returns the error lookups of name fail with while
+// the content is stale and a `maintenance_file` is set, or nil.
+func (r *Repo) maintenanceError(op, name string) error {
+	if r.MaintenanceFile == "" {
+		return nil
+	}
+	f := r.staleFailure()
+	if f == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: gapError(f.id, errStale)}
+}
+
+// Healthy reports whether the repo is serving current content:
+// the last refresh succeeded and the content is not stale.
+func (r *Repo) Healthy() bool {
+	return r.refreshErr.Load() == nil && !r.stale()
+}
+
+// Open implements fs.FS. Names that are not valid according to
+// fs.ValidPath, like `../etc/passwd` or `/etc/passwd`, fail with
+// fs.ErrInvalid before reaching the tree or the fallthrough
+// filesystem. The same goes for Stat.
 func (r *Repo) Open(name string) (fs.File, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.statFs.Open(name)
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	name = r.resolveAlias(name)
+	if err := r.maintenanceError("open", name); err != nil {
+		r.count(err)
+		return nil, err
+	}
+	snap := r.current.Load()
+	f, err := snap.statFs.Open(name)
+	if r.fallthroughFS != nil && errors.Is(err, fs.ErrNotExist) {
+		f, err = r.fallthroughFS.Open(name)
+	}
+	r.count(err)
+	if err == nil && len(r.DirectoryIndex) > 0 {
+		f = r.openIndex(snap.statFs, name, f)
+	}
+	return f, err
+}
+
+// resolveAlias returns the path whose content is served at name,
+// per `alias`. The longest matching alias wins.
+func (r *Repo) resolveAlias(name string) string {
+	var match string
+	for from := range r.Alias {
+		if len(from) > len(match) && (name == from || strings.HasPrefix(name, from+"/")) {
+			match = from
+		}
+	}
+	if match == "" {
+		return name
+	}
+	return path.Join(r.Alias[match], strings.TrimPrefix(name, match))
+}
+
+// openIndex returns the first `directory_index` file present in the
+// directory dir opened at name, or dir itself if it is not a directory
+// or has none of them.
+func (r *Repo) openIndex(fsys fs.FS, name string, dir fs.File) fs.File {
+	info, err := dir.Stat()
+	if err != nil || !info.IsDir() {
+		return dir
+	}
+	for _, index := range r.DirectoryIndex {
+		f, err := fsys.Open(path.Join(name, index))
+		if err != nil {
+			continue
+		}
+		if info, err := f.Stat(); err == nil && !info.IsDir() {
+			dir.Close()
+			return f
+		}
+		f.Close()
+	}
+	return dir
 }
 
 func (r *Repo) Stat(name string) (fs.FileInfo, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	f, err := r.statFs.Open(name)
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	name = r.resolveAlias(name)
+	if err := r.maintenanceError("stat", name); err != nil {
+		r.count(err)
+		return nil, err
+	}
+	f, err := r.current.Load().statFs.Open(name)
+	if r.fallthroughFS != nil && errors.Is(err, fs.ErrNotExist) {
+		info, err := fs.Stat(r.fallthroughFS, name)
+		r.count(err)
+		return info, err
+	}
+	r.count(err)
 	if err != nil {
 		return nil, err
 	}
 	return f.Stat()
 }
 
+// count records a lookup and whether it missed.
+func (r *Repo) count(err error) {
+	r.lookups.Inc()
+	if errors.Is(err, fs.ErrNotExist) {
+		r.misses.Inc()
+	}
+}
+
+// OpenHash opens the blob identified by the object hash h in the
+// current clone, without any of the configured transformations
+// applied. The tree does not index blobs by hash, so the first lookup
+// of every commit walks the tree and hashes the content of its files.
+func (r *Repo) OpenHash(h gitfs.Hash) (fs.File, error) {
+	snap := r.current.Load()
+	index, err := snap.blobIndex()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := index.byHash[h]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: h.String(), Err: fs.ErrNotExist}
+	}
+	return snap.tree.Open(name)
+}
+
 func (r *Repo) refresh() {
-	t := time.NewTicker(time.Duration(r.RefreshPeriod))
+	period := time.Duration(r.RefreshPeriod)
+	t := time.NewTicker(period)
+	maintenance := false
 	for {
 		select {
 		case <-r.ctx.Done():
@@ -112,41 +1094,360 @@ func (r *Repo) refresh() {
 			t.Stop()
 			return
 		case <-t.C:
-			r.logger.Debug("checking `ref` hash",
-				zap.String("ref", r.Ref),
-				zap.String("hash", r.hash.String()),
-			)
-			h, err := r.repo.Resolve(r.Ref)
-			if err != nil {
-				r.logger.Error("error resolving new hash of the `ref`", zap.Error(err))
+			_, err := r.pull()
+			if r.ctx.Err() != nil {
+				// cleaned up during the pull; stop on the next iteration
 				continue
 			}
-			if h == r.hash {
-				r.logger.Debug("no change in `ref` hash")
+			open := r.circuitOpen.Load()
+			failure := r.recordRefresh(err)
+			if err == nil {
+				if maintenance {
+					r.logger.Info("refresh succeeded; no longer failing lookups for the maintenance page")
+					maintenance = false
+				}
+				if open {
+					r.logger.Info("remote recovered; closing circuit",
+						zap.Duration("period", period),
+					)
+					t.Reset(period)
+					r.circuitOpen.Store(false)
+				}
 				continue
 			}
-			r.logger.Info(
-				"`ref` hash changed; cloning",
-				zap.String("ref", r.Ref),
-				zap.String("old", r.hash.String()),
-				zap.String("new", h.String()),
-			)
-			hash, f, err := r.repo.Clone(r.Ref)
-			if err != nil {
-				r.logger.Error("error cloning `ref`", zap.Error(err))
+			if r.MaintenanceFile != "" && !maintenance && r.stale() {
+				r.logger.Warn("content is stale; failing lookups with status 503 for the maintenance page",
+					zap.Duration("stale_threshold", time.Duration(r.StaleThreshold)),
+					zap.Time("failing_since", failure.since),
+					zap.String("error_id", failure.id),
+				)
+				maintenance = true
+			}
+			if open {
+				r.logger.Debug("circuit open; probe failed", zap.Error(err))
 				continue
 			}
-			r.mu.Lock()
-			r.hash = hash
-			r.statFs = statFs{f}
-			r.mu.Unlock()
+			r.logger.Error("error refreshing `ref`", zap.Error(err), zap.String("error_id", failure.id))
+			// refreshes through the admin API count too
+			if failures := int(r.failures.Load()); r.CircuitThreshold > 0 && failures >= r.CircuitThreshold {
+				backoff := time.Duration(r.CircuitBackoff)
+				if backoff == 0 {
+					backoff = defaultCircuitBackoff
+				}
+				r.logger.Warn("remote failing repeatedly; opening circuit",
+					zap.Int("failures", failures),
+					zap.Duration("backoff", backoff),
+				)
+				r.events.Emit(r.caddyCtx, "gitfs_circuit_open", map[string]any{
+					"filesystem": r.Name,
+					"url":        redactURL(r.URL),
+					"ref":        r.Ref,
+					"failures":   failures,
+					"backoff":    backoff,
+				})
+				t.Reset(backoff)
+				r.circuitOpen.Store(true)
+			}
+		}
+	}
+}
+
+// A pullResult describes the outcome of a pull.
+type pullResult struct {
+	old      gitfs.Hash
+	new      gitfs.Hash
+	changed  bool
+	duration time.Duration
+}
+
+// pull resolves `ref` and, if its hash changed, clones the new
+// commit and swaps it in.
+func (r *Repo) pull() (pullResult, error) {
+	r.pullMu.Lock()
+	defer r.pullMu.Unlock()
+	start := time.Now()
+	res := pullResult{old: r.currentHash()}
+	if r.Auth != nil {
+		if err := r.renewAuth(); err != nil {
+			res.duration = time.Since(start)
+			return res, err
+		}
+	}
+	r.logger.Debug("checking `ref` hash",
+		zap.String("ref", r.Ref),
+		zap.String("hash", res.old.String()),
+	)
+	rem := r.remote.Load()
+	h, err := rem.repo.Resolve(r.Ref)
+	if len(r.Mirrors) > 0 && (rem.mirror > 0 || err != nil && !isUnknownRef(err)) {
+		if next, derr := r.dial(); derr == nil && next.mirror != rem.mirror {
+			r.logger.Warn("switching remotes",
+				zap.String("from", redactURL(r.remoteURL(rem.mirror))),
+				zap.String("to", redactURL(r.remoteURL(next.mirror))),
+			)
+			r.remote.Store(next)
+			rem = next
+			h, err = rem.repo.Resolve(r.Ref)
+		}
+	}
+	if err != nil && res.old == (gitfs.Hash{}) && r.remoteEmpty() {
+		r.logger.Debug("the repository is still empty")
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	if err != nil && isUnknownRef(err) && r.refDeleted(rem.url) {
+		h, err = r.onRefDeleted(rem)
+		if err != nil {
+			res.duration = time.Since(start)
+			return res, err
+		}
+	} else if err == nil && r.fallback.Swap(false) {
+		r.logger.Info("`ref` is back on the remote; no longer following 'fallback_ref'",
+			zap.String("ref", r.Ref),
+		)
+	}
+	if err != nil {
+		return res, fmt.Errorf("resolving new hash of the `ref`: %v", describeUnknownRef(rem.url, r.Ref, err))
+	}
+	res.new = h
+	if h != res.old && r.checkExpectedHash(h) != nil {
+		// pinning the served commit is deliberate, so this is not a
+		// failed refresh: it must not open the circuit or make the
+		// content stale
+		if prev := r.refused.Swap(&h); prev == nil || *prev != h {
+			r.logger.Warn("`ref` no longer points at 'expected_hash'; keeping the served commit",
+				zap.String("ref", r.Ref),
+				zap.String("hash", res.old.String()),
+				zap.String("refused", h.String()),
+			)
+		}
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	r.refused.Store(nil)
+	if h == res.old {
+		r.logger.Debug("no change in `ref` hash")
+		if r.ManualPromote && r.staged.Swap(nil) != nil {
+			r.logger.Info("`ref` moved back to the served hash; dropping the staged commit")
+		}
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	if staged := r.staged.Load(); staged != nil && staged.hash == h {
+		r.logger.Debug("`ref` hash already staged")
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	if r.Sentinel != "" && h == r.sentinelSkipped {
+		r.logger.Debug("`ref` hash already skipped for an unchanged sentinel")
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	r.logger.Info(
+		"`ref` hash changed; cloning",
+		zap.String("ref", r.Ref),
+		zap.String("old", res.old.String()),
+		zap.String("new", h.String()),
+	)
+	f, err := rem.repo.CloneHash(h)
+	if err != nil {
+		return res, fmt.Errorf("cloning `ref`: %v", err)
+	}
+	f, err = r.strip(h, f)
+	if err != nil {
+		return res, fmt.Errorf("%v; keeping %s", err, res.old)
+	}
+	if r.Verify {
+		if err := verifyTree(f); err != nil {
+			return res, fmt.Errorf("verifying the clone of %s: %v; keeping %s", h, err, res.old)
+		}
+	}
+	// a config reload may have cleaned the filesystem up while it was
+	// cloning; its replacement shares the name, metrics and events, so
+	// nothing may be published past this point
+	if err := r.ctx.Err(); err != nil {
+		return res, fmt.Errorf("cleaned up while cloning %s: %v", h, err)
+	}
+	if r.Sentinel != "" && !r.sentinelChanged(r.current.Load(), f) {
+		r.logger.Info("sentinel unchanged; keeping the served commit",
+			zap.String("ref", r.Ref),
+			zap.String("sentinel", r.Sentinel),
+			zap.String("hash", res.old.String()),
+			zap.String("skipped", h.String()),
+		)
+		r.sentinelSkipped = h
+		res.duration = time.Since(start)
+		return res, nil
+	}
+	snap := r.newSnapshot(h, f)
+	old := r.current.Load()
+	if r.DiffChanges {
+		snap.changes, err = diffSnapshots(old, snap)
+		if err != nil {
+			r.logger.Error("error computing changed files", zap.String("hash", h.String()), zap.Error(err))
+		}
+	}
+	msg := "cloned `ref`"
+	if r.ManualPromote {
+		r.staged.Store(snap)
+		msg = "cloned `ref`; staged for promotion"
+	} else {
+		r.serve(snap)
+		r.emitRefreshed(old, snap)
+		res.changed = true
+	}
+	res.duration = time.Since(start)
+	r.logger.Info(msg,
+		zap.String("ref", r.Ref),
+		zap.String("hash", h.String()),
+		zap.Int("objects", snap.objects),
+		zap.Int64("size", snap.size),
+		zap.Int("objects_delta", snap.objects-old.objects),
+		zap.Int64("size_delta", snap.size-old.size),
+		zap.Duration("duration", res.duration),
+	)
+	return res, nil
+}
+
+// sentinelChanged reports whether the `sentinel` file of tree differs
+// from that of the served snapshot. A missing file counts as a change
+// only if the other one has it, and a snapshot holding no commit, such
+// as the empty tree of a repository without commits, is always replaced.
+func (r *Repo) sentinelChanged(served *snapshot, tree fs.FS) bool {
+	if served.hash == (gitfs.Hash{}) {
+		return true
+	}
+	old, oldErr := fs.ReadFile(served.tree, r.Sentinel)
+	data, err := fs.ReadFile(tree, r.Sentinel)
+	if oldErr != nil || err != nil {
+		return (oldErr == nil) != (err == nil)
+	}
+	return !bytes.Equal(old, data)
+}
+
+// emitRefreshed emits the `gitfs_refreshed` event for a new commit
+// being served in place of old, with the changed files if they were
+// computed.
+func (r *Repo) emitRefreshed(old, snap *snapshot) {
+	data := map[string]any{
+		"filesystem": r.Name,
+		"url":        redactURL(r.URL),
+		"ref":        r.Ref,
+		"old":        old.hash.String(),
+		"new":        snap.hash.String(),
+	}
+	if r.DiffChanges {
+		data["changes"] = snap.changes
+	}
+	r.events.Emit(r.caddyCtx, "gitfs_refreshed", data)
+}
+
+// checkExpectedHash returns an error if `expected_hash` is set and
+// h is not it.
+func (r *Repo) checkExpectedHash(h gitfs.Hash) error {
+	if r.ExpectedHash == "" || h == r.expectedHash {
+		return nil
+	}
+	return fmt.Errorf("`ref` %s resolved to %s instead of 'expected_hash' %s; refusing to serve it", r.Ref, h, r.expectedHash)
+}
+
+// refDeleted reports whether the remote at repoURL is reachable but
+// no longer advertises `ref`, as opposed to failing transiently.
+func (r *Repo) refDeleted(repoURL string) bool {
+	refs, err := listRefs(repoURL, r.Ref)
+	if err != nil {
+		return false
+	}
+	for _, ref := range refs {
+		if ref.name == r.Ref {
+			return false
+		}
+	}
+	return true
+}
+
+// onRefDeleted applies `on_ref_deleted` once `ref` is gone from the
+// remote, returning the hash to serve instead, if any.
+func (r *Repo) onRefDeleted(rem *remote) (gitfs.Hash, error) {
+	switch r.OnRefDeleted {
+	case refDeletedError:
+		// as in pull, a filesystem cleaned up meanwhile must not
+		// publish anything its replacement would be seen with
+		if err := r.ctx.Err(); err != nil {
+			return gitfs.Hash{}, fmt.Errorf("cleaned up while checking `ref` %s: %v", r.Ref, err)
+		}
+		if r.currentHash() != (gitfs.Hash{}) {
+			id := errorID()
+			r.logger.Error("`ref` was deleted from the remote; no longer serving content",
+				zap.String("ref", r.Ref),
+				zap.String("error_id", id),
+			)
+			r.serve(&snapshot{tree: emptyFS{}, statFs: statFs{errFS{gapError(id, errRefDeleted)}}})
+		}
+		return gitfs.Hash{}, fmt.Errorf("`ref` %s: %w", r.Ref, errRefDeleted)
+	case refDeletedFallback:
+		h, err := rem.repo.Resolve(r.FallbackRef)
+		if err != nil {
+			return h, fmt.Errorf("`ref` %s was deleted from the remote; resolving 'fallback_ref': %v", r.Ref, err)
+		}
+		if !r.fallback.Swap(true) {
+			r.logger.Warn("`ref` was deleted from the remote; following 'fallback_ref'",
+				zap.String("ref", r.Ref),
+				zap.String("fallback_ref", r.FallbackRef),
+			)
 		}
+		return h, nil
+	default:
+		return gitfs.Hash{}, fmt.Errorf("`ref` %s was deleted from the remote; serving the last known commit %s", r.Ref, r.currentHash())
 	}
 }
 
+// remoteEmpty reports whether the remote advertises no refs at all,
+// as is the case for a repository no commit was pushed to yet.
+func (r *Repo) remoteEmpty() bool {
+	refs, err := listRefs(r.remote.Load().url, "HEAD", "refs/")
+	return err == nil && len(refs) == 0
+}
+
+// promote serves the commit staged by the last refresh in
+// `manual_promote` mode, returning the previously served and the
+// promoted hashes.
+func (r *Repo) promote() (old, promoted gitfs.Hash, err error) {
+	if !r.ManualPromote {
+		return old, promoted, fmt.Errorf("'manual_promote' is not enabled")
+	}
+	// a pull in progress must not stage or report against the commit
+	// served before the promotion
+	r.pullMu.Lock()
+	defer r.pullMu.Unlock()
+	snap := r.staged.Swap(nil)
+	if snap == nil {
+		return old, promoted, errNothingStaged
+	}
+	prev := r.serve(snap)
+	r.logger.Info("promoted staged commit",
+		zap.String("ref", r.Ref),
+		zap.String("old", prev.hash.String()),
+		zap.String("new", snap.hash.String()),
+	)
+	r.emitRefreshed(prev, snap)
+	return prev.hash, snap.hash, nil
+}
+
+// stagedHash returns the hash of the commit awaiting promotion,
+// if any.
+func (r *Repo) stagedHash() (gitfs.Hash, bool) {
+	snap := r.staged.Load()
+	if snap == nil {
+		return gitfs.Hash{}, false
+	}
+	return snap.hash, true
+}
+
 // Cleanup implements caddy.CleanerUpper.
 func (r *Repo) Cleanup() error {
 	r.logger.Debug("cleaning up")
+	unregisterRepo(r)
 	r.cancel()
 	return nil
 }
@@ -159,24 +1460,12 @@ func (r *Repo) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if !d.Args(&arg) {
 		return d.Err("missing URL")
 	}
-	u, err := url.Parse(arg)
-	if err != nil {
-		return err
-	}
-	parts := strings.Split(u.Path, `@`)
-	switch len(parts) {
-	case 0:
-		// should be impossible
-		return d.Errf("the path consists of 0 parts, should have more: %v", parts)
-	case 1:
-		r.URL = arg
-		r.Ref = "HEAD"
-	case 2:
-		u.Path = strings.TrimSuffix(u.Path, `@`+parts[1])
-		r.URL = u.String()
-	}
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
+		case "name":
+			if !d.Args(&r.Name) {
+				return d.ArgErr()
+			}
 		case "ref":
 			if !d.Args(&r.Ref) {
 				return d.ArgErr()
@@ -186,18 +1475,270 @@ func (r *Repo) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if !d.Args(&dur) {
 				return d.ArgErr()
 			}
+			if dur == "never" {
+				r.RefreshPeriod = 0
+				break
+			}
 			d, err := caddy.ParseDuration(dur)
 			if err != nil {
 				return err
 			}
 			r.RefreshPeriod = caddy.Duration(d)
+		case "ready_timeout":
+			var dur string
+			if !d.Args(&dur) {
+				return d.ArgErr()
+			}
+			d, err := caddy.ParseDuration(dur)
+			if err != nil {
+				return err
+			}
+			r.ReadyTimeout = caddy.Duration(d)
+		case "startup_delay":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			delay, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			r.StartupDelay = caddy.Duration(delay)
+			if len(args) == 2 {
+				jitter, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return err
+				}
+				r.StartupJitter = caddy.Duration(jitter)
+			}
+		case "circuit_breaker":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid circuit breaker threshold %q: %v", args[0], err)
+			}
+			r.CircuitThreshold = threshold
+			if len(args) == 2 {
+				backoff, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return err
+				}
+				r.CircuitBackoff = caddy.Duration(backoff)
+			}
+		case "expected_hash":
+			if !d.Args(&r.ExpectedHash) {
+				return d.ArgErr()
+			}
+		case "on_ref_deleted":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			r.OnRefDeleted = args[0]
+			switch {
+			case args[0] == refDeletedFallback && len(args) == 2:
+				r.FallbackRef = args[1]
+			case len(args) != 1:
+				return d.ArgErr()
+			}
+		case "verify":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.Verify = true
+		case "diff_changes":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.DiffChanges = true
+		case "log_level":
+			if !d.Args(&r.LogLevel) {
+				return d.ArgErr()
+			}
+		case "allow_empty":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.AllowEmpty = true
+		case "allowed_hosts":
+			r.AllowedHosts = d.RemainingArgs()
+			if len(r.AllowedHosts) == 0 {
+				return d.ArgErr()
+			}
+		case "mirrors":
+			r.Mirrors = d.RemainingArgs()
+			if len(r.Mirrors) == 0 {
+				return d.ArgErr()
+			}
+		case "sentinel":
+			if !d.Args(&r.Sentinel) {
+				return d.ArgErr()
+			}
+		case "strip_components":
+			var n string
+			if !d.Args(&n) {
+				return d.ArgErr()
+			}
+			strip, err := strconv.Atoi(n)
+			if err != nil {
+				return d.Errf("invalid strip_components %q: %v", n, err)
+			}
+			r.StripComponents = strip
+		case "manual_promote":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.ManualPromote = true
+		case "fallthrough":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if r.FallthroughRaw != nil {
+				return d.Err("fallthrough filesystem already specified")
+			}
+			name := d.Val()
+			modID := "caddy.fs." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			fsys, ok := unm.(fs.FS)
+			if !ok {
+				return d.Errf("module %s (%T) is not a supported file system implementation (requires fs.FS)", modID, unm)
+			}
+			r.FallthroughRaw = caddyconfig.JSONModuleObject(fsys, "backend", name, nil)
+		case "auth":
+			r.Auth = new(Auth)
+			if err := r.Auth.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "stale_threshold":
+			var dur string
+			if !d.Args(&dur) {
+				return d.ArgErr()
+			}
+			d, err := caddy.ParseDuration(dur)
+			if err != nil {
+				return err
+			}
+			r.StaleThreshold = caddy.Duration(d)
+		case "maintenance_file":
+			if !d.Args(&r.MaintenanceFile) {
+				return d.ArgErr()
+			}
+		case "max_file_size":
+			var size string
+			if !d.Args(&size) {
+				return d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(size)
+			if err != nil {
+				return d.Errf("invalid max_file_size %q: %v", size, err)
+			}
+			r.MaxFileSize = int64(n)
+		case "alias":
+			var from, to string
+			if !d.Args(&from, &to) {
+				return d.ArgErr()
+			}
+			if r.Alias == nil {
+				r.Alias = make(map[string]string)
+			}
+			r.Alias[from] = to
+		case "allow_extensions":
+			r.AllowExtensions = d.RemainingArgs()
+			if len(r.AllowExtensions) == 0 {
+				return d.ArgErr()
+			}
+		case "directory_index":
+			r.DirectoryIndex = d.RemainingArgs()
+			if len(r.DirectoryIndex) == 0 {
+				return d.ArgErr()
+			}
+		case "headers_file":
+			if !d.Args(&r.HeadersFile) {
+				return d.ArgErr()
+			}
+		case "charset":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			r.Charset = &Charset{Name: args[0], Files: args[1:]}
+		case "text_normalize":
+			r.TextNormalize = &TextNormalize{Extensions: d.RemainingArgs()}
+			if len(r.TextNormalize.Extensions) == 0 {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "crlf":
+					r.TextNormalize.CRLF = true
+				default:
+					return d.Errf("unrecognized text_normalize subdirective %s", d.Val())
+				}
+			}
 		default:
 			return d.Errf("unrecognized subdirective %s", d.Val())
 		}
 	}
+	if r.Ref != "" {
+		// an explicit `ref` means the URL is taken literally
+		r.URL = arg
+		return nil
+	}
+	var err error
+	r.URL, r.Ref, err = splitRefSuffix(arg)
+	if err != nil {
+		return d.Errf("parsing URL %q: %v", arg, err)
+	}
 	return nil
 }
 
+// splitRefSuffix splits an `@ref` suffix off the path of the URL
+// raw, returning the URL without it and the ref. An `@` in the userinfo
+// or at the start of a path segment (e.g. `/@scope/repo`) is not a ref
+// separator, nor is an escaped `%40`. The URL is not parsed as a whole
+// because its userinfo may hold placeholders.
+func splitRefSuffix(raw string) (string, string, error) {
+	rest := raw
+	if _, after, ok := strings.Cut(rest, "://"); ok {
+		rest = after
+	}
+	// the authority ends at the first slash outside of a placeholder
+	slash, depth := -1, 0
+	for i, c := range rest {
+		if c == '{' {
+			depth++
+		} else if c == '}' && depth > 0 {
+			depth--
+		} else if c == '/' && depth == 0 {
+			slash = i
+			break
+		}
+	}
+	if slash < 0 {
+		return raw, "", nil
+	}
+	start := len(raw) - len(rest) + slash
+	p := raw[start:]
+	i := strings.LastIndex(p, `@`)
+	if i <= 0 || p[i-1] == '/' {
+		return raw, "", nil
+	}
+	ref, err := url.PathUnescape(p[i+1:])
+	if err != nil {
+		return "", "", err
+	}
+	if ref == "" {
+		return "", "", fmt.Errorf("empty ref after '@'")
+	}
+	return raw[:start+i], ref, nil
+}
+
 var (
 	_ caddy.Module          = (*Repo)(nil)
 	_ caddy.Provisioner     = (*Repo)(nil)
@@ -0,0 +1,344 @@
+package gitfs
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Preview{})
+	httpcaddyfile.RegisterHandlerDirective("gitfs_preview", parsePreview)
+}
+
+const (
+	defaultPreviewParam = "preview"
+	defaultPreviewTTL   = 10 * time.Minute
+	defaultPreviewMax   = 10
+	// the shortest interval between sweeps for unused clones
+	minPreviewSweep = time.Second
+)
+
+// Preview is a middleware serving the ref named by a query parameter
+// or a cookie from the repository of a named git filesystem, for
+// preview deployments and A/B tests. Requests naming no ref are passed
+// on. Preview clones are reused for `ttl` and dropped once unused for
+// as long; at most `max` of them, totalling at most `max_size`, are
+// kept, evicting the least recently used. Since any visitor can
+// request clones, the route should be guarded, e.g. with a matcher on
+// a secret header or the client IP.
+type Preview struct {
+	// The name of the git filesystem whose repository to clone from
+	Filesystem string `json:"filesystem,omitempty"`
+
+	// The query parameter naming the ref to serve. Default: `preview`
+	Param string `json:"param,omitempty"`
+
+	// The cookie naming the ref to serve for requests without the query
+	// parameter, e.g. to keep each visitor of an A/B test on one version
+	// of the content. Requests without either are passed on, to serve
+	// the ref of the filesystem, as are those whose cookie names a ref
+	// that is invalid or cannot be cloned. Disabled when empty.
+	Cookie string `json:"cookie,omitempty"`
+
+	// How long a preview clone is reused before the ref is cloned
+	// again, and how long an unused one is kept. Default: 10m
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The maximum number of preview clones kept. Default: 10
+	Max int `json:"max,omitempty"`
+
+	// The maximum total size in bytes of the blobs of the preview
+	// clones kept. An empty value sets no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	mu     *sync.Mutex
+	clones map[string]*previewClone
+	logger *zap.Logger
+}
+
+// A previewClone is a cached clone of a preview ref. Its snap and
+// err are set before ready is closed; snap and used are guarded by
+// the mutex of the Preview.
+type previewClone struct {
+	ready   chan struct{}
+	snap    *snapshot
+	err     error
+	created time.Time
+	used    time.Time
+}
+
+// CaddyModule returns the Caddy module information.
+func (Preview) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.gitfs_preview",
+		New: func() caddy.Module { return new(Preview) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (p *Preview) Provision(ctx caddy.Context) error {
+	if p.Filesystem == "" {
+		return fmt.Errorf("'filesystem' is empty")
+	}
+	if p.Param == "" {
+		p.Param = defaultPreviewParam
+	}
+	if p.TTL == 0 {
+		p.TTL = caddy.Duration(defaultPreviewTTL)
+	}
+	if p.TTL < 0 {
+		return fmt.Errorf("'ttl' is negative")
+	}
+	if p.Max == 0 {
+		p.Max = defaultPreviewMax
+	}
+	if p.Max < 0 {
+		return fmt.Errorf("'max' is negative")
+	}
+	if p.MaxSize < 0 {
+		return fmt.Errorf("'max_size' is negative")
+	}
+	p.mu = new(sync.Mutex)
+	p.clones = make(map[string]*previewClone)
+	p.logger = ctx.Logger()
+	go p.sweep(ctx)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p Preview) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	ref := r.URL.Query().Get(p.Param)
+	fromCookie := false
+	if ref == "" && p.Cookie != "" {
+		// the response depends on the cookie, whether or not it is set
+		w.Header().Add("Vary", "Cookie")
+		if c, err := r.Cookie(p.Cookie); err == nil {
+			ref, fromCookie = c.Value, true
+		}
+	}
+	if ref == "" {
+		return next.ServeHTTP(w, r)
+	}
+	if err := validateRef(ref); err != nil {
+		if fromCookie {
+			// a stale or tampered cookie must not lock the visitor out
+			p.logger.Debug("invalid ref in cookie; serving the ref of the filesystem", zap.String("ref", ref), zap.Error(err))
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	repo, ok := lookupRepo(p.Filesystem)
+	if !ok {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("unknown git filesystem %q", p.Filesystem))
+	}
+	if err := repo.checkHost(r); err != nil {
+		return err
+	}
+	snap, err := p.clone(repo, ref)
+	if err != nil {
+		if fromCookie {
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if name := strings.Trim(path.Clean("/"+r.URL.Path), "/"); !hasIndex(snap.statFs, name) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s is a directory without an index.html", name))
+	}
+	http.FileServer(http.FS(snap.statFs)).ServeHTTP(w, r)
+	return nil
+}
+
+// hasIndex reports whether name is not a directory, or a directory
+// with an index.html. The standard file server lists directories that
+// have none, which the file server of the site does not do unless
+// browsing is enabled, so previews must not either.
+func hasIndex(fsys fs.StatFS, name string) bool {
+	if name == "" {
+		name = "."
+	}
+	info, err := fsys.Stat(name)
+	if err != nil || !info.IsDir() {
+		return true
+	}
+	_, err = fsys.Stat(path.Join(name, "index.html"))
+	return err == nil
+}
+
+// clone returns the cached clone of ref, cloning it if it is missing
+// or expired. Concurrent requests for the same ref share one clone.
+func (p Preview) clone(repo *Repo, ref string) (*snapshot, error) {
+	p.mu.Lock()
+	c, ok := p.clones[ref]
+	if !ok || time.Since(c.created) > time.Duration(p.TTL) {
+		c = &previewClone{ready: make(chan struct{}), created: time.Now()}
+		p.clones[ref] = c
+		go p.fill(c, repo, ref)
+	}
+	c.used = time.Now()
+	p.evict()
+	p.mu.Unlock()
+
+	<-c.ready
+	return c.snap, c.err
+}
+
+// fill clones ref into c, dropping c from the cache on failure so
+// the next request tries again.
+func (p Preview) fill(c *previewClone, repo *Repo, ref string) {
+	defer close(c.ready)
+	h, tree, err := repo.remote.Load().repo.Clone(ref)
+	if err == nil {
+		tree, err = repo.strip(h, tree)
+	}
+	if err != nil {
+		c.err = fmt.Errorf("cloning preview ref %s: %v", ref, err)
+		p.logger.Error("error cloning preview", zap.String("ref", ref), zap.Error(err))
+		p.mu.Lock()
+		if p.clones[ref] == c {
+			delete(p.clones, ref)
+		}
+		p.mu.Unlock()
+		return
+	}
+	p.logger.Info("cloned preview", zap.String("ref", ref), zap.String("hash", h.String()))
+	snap := repo.newSnapshot(h, tree)
+	p.mu.Lock()
+	c.snap = snap
+	p.evict()
+	p.mu.Unlock()
+}
+
+// evict drops the least recently used clones while there are more
+// than `max` or they total more than `max_size`. Requests already
+// holding an evicted clone keep serving it. It must be called with
+// p.mu held.
+func (p Preview) evict() {
+	for len(p.clones) > 0 {
+		var size int64
+		var lru string
+		for ref, c := range p.clones {
+			if c.snap != nil {
+				size += c.snap.size
+			}
+			if lru == "" || c.used.Before(p.clones[lru].used) {
+				lru = ref
+			}
+		}
+		if len(p.clones) <= p.Max && (p.MaxSize == 0 || size <= p.MaxSize) {
+			return
+		}
+		delete(p.clones, lru)
+	}
+}
+
+// sweep drops the clones unused for `ttl` until ctx is done, so that
+// idle previews do not hold on to memory.
+func (p Preview) sweep(ctx caddy.Context) {
+	t := time.NewTicker(max(time.Duration(p.TTL)/2, minPreviewSweep))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.mu.Lock()
+			for ref, c := range p.clones {
+				if time.Since(c.used) > time.Duration(p.TTL) {
+					delete(p.clones, ref)
+					p.logger.Debug("dropped unused preview", zap.String("ref", ref))
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	gitfs_preview <filesystem> {
+//		param <name>
+//		cookie <name>
+//		ttl <duration>
+//		max <count>
+//		max_size <size>
+//	}
+func (p *Preview) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// consume the directive
+	d.Next()
+	if !d.Args(&p.Filesystem) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "param":
+			if !d.Args(&p.Param) {
+				return d.ArgErr()
+			}
+		case "cookie":
+			if !d.Args(&p.Cookie) {
+				return d.ArgErr()
+			}
+		case "ttl":
+			var dur string
+			if !d.Args(&dur) {
+				return d.ArgErr()
+			}
+			d, err := caddy.ParseDuration(dur)
+			if err != nil {
+				return err
+			}
+			p.TTL = caddy.Duration(d)
+		case "max":
+			var n string
+			if !d.Args(&n) {
+				return d.ArgErr()
+			}
+			max, err := strconv.Atoi(n)
+			if err != nil {
+				return d.Errf("invalid max %q: %v", n, err)
+			}
+			p.Max = max
+		case "max_size":
+			var size string
+			if !d.Args(&size) {
+				return d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(size)
+			if err != nil {
+				return d.Errf("invalid max_size %q: %v", size, err)
+			}
+			p.MaxSize = int64(n)
+		default:
+			return d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+func parsePreview(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var p Preview
+	err := p.UnmarshalCaddyfile(h.Dispenser)
+	return p, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Preview)(nil)
+	_ caddyhttp.MiddlewareHandler = Preview{}
+	_ caddyfile.Unmarshaler       = (*Preview)(nil)
+)
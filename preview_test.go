@@ -0,0 +1,122 @@
+package gitfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPreviewTTL(t *testing.T) {
+	for _, tt := range []struct {
+		ttl     caddy.Duration
+		wantErr bool
+	}{
+		{ttl: 0},
+		{ttl: 1},
+		{ttl: caddy.Duration(time.Minute)},
+		{ttl: caddy.Duration(-time.Second), wantErr: true},
+	} {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		p := Preview{Filesystem: "x", TTL: tt.ttl}
+		err := p.Provision(ctx)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ttl %v: err = %v, want error: %v", time.Duration(tt.ttl), err, tt.wantErr)
+		}
+		cancel()
+		if err == nil {
+			// returns right away on the done context, but must not
+			// panic creating its ticker first
+			p.sweep(ctx)
+		}
+	}
+}
+
+func TestPreviewDirectories(t *testing.T) {
+	rem := newTestRemote(t, map[string]string{
+		"a.txt":              "a",
+		"dir/sub/index.html": "index",
+	})
+	if err := loadRepos(t, map[string]any{"name": "preview", "url": rem.URL}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	p := Preview{Filesystem: "preview"}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/a.txt", http.StatusOK},
+		{"/dir/sub/", http.StatusOK},
+		{"/", http.StatusNotFound},
+		{"/dir/", http.StatusNotFound},
+		{"/missing", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		err := p.ServeHTTP(w, httptest.NewRequest("GET", tt.path+"?preview=refs/heads/main", nil), nil)
+		status := w.Code
+		var he caddyhttp.HandlerError
+		if errors.As(err, &he) {
+			status = he.StatusCode
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.path, status, tt.want)
+		}
+	}
+}
+
+func TestPreviewCookie(t *testing.T) {
+	rem := newTestRemote(t, map[string]string{"a.txt": "main"})
+	rem.git(rem.dir+"/src", "checkout", "-q", "-b", "variant")
+	rem.Commit(map[string]string{"a.txt": "variant"})
+	rem.Push("HEAD:refs/heads/variant")
+	if err := loadRepos(t, map[string]any{"name": "cookie", "url": rem.URL}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	p := Preview{Filesystem: "cookie", Cookie: "gitfs_ref"}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("next"))
+		return err
+	})
+	for _, tt := range []struct {
+		cookie string
+		want   string
+	}{
+		{"", "next"},
+		{"refs/heads/variant", "variant"},
+		{"../../etc/passwd", "next"},
+		{"refs/heads/deleted", "next"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "gitfs_ref", Value: tt.cookie})
+		}
+		if err := p.ServeHTTP(w, r, next); err != nil {
+			t.Errorf("cookie %q: %v", tt.cookie, err)
+			continue
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("cookie %q: served %q, want %q", tt.cookie, got, tt.want)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Cookie" {
+			t.Errorf("cookie %q: Vary %q, want Cookie", tt.cookie, vary)
+		}
+	}
+}
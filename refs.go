@@ -0,0 +1,186 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rsc.io/gitfs"
+)
+
+// A remoteRef is a ref advertised by the remote repository.
+type remoteRef struct {
+	name   string     // "refs/heads/main", "HEAD"
+	hash   gitfs.Hash // the hash the ref points at
+	target string     // the ref a symbolic ref points at, if any
+}
+
+// listRefs runs the ls-refs command of the git protocol v2 against
+// the repository at repoURL, returning the refs with the given
+// prefixes. rsc.io/gitfs does not expose the ref advertisement,
+// so this speaks just enough of the protocol to read it, including
+// the symref targets gitfs discards.
+// See https://git-scm.com/docs/protocol-v2#_ls_refs.
+func listRefs(repoURL string, prefixes ...string) ([]remoteRef, error) {
+	var body bytes.Buffer
+	writePkt(&body, "command=ls-refs")
+	body.WriteString("0001")
+	writePkt(&body, "peel")
+	writePkt(&body, "symrefs")
+	for _, prefix := range prefixes {
+		writePkt(&body, "ref-prefix "+prefix)
+	}
+	body.WriteString("0000")
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(repoURL, "/")+"/git-upload-pack", &body)
+	if err != nil {
+		return nil, fmt.Errorf("ls-refs: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ls-refs: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ls-refs: %v", resp.Status)
+	}
+
+	var refs []remoteRef
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := readPkt(br)
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ls-refs: parsing response: %v", err)
+		}
+		ref, err := parseRefLine(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("ls-refs: parsing response: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// defaultBranch returns the branch the HEAD of the remote
+// repository at repoURL points at.
+func defaultBranch(repoURL string) (string, error) {
+	refs, err := listRefs(repoURL, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if ref.name == "HEAD" && ref.target != "" {
+			return ref.target, nil
+		}
+	}
+	return "", fmt.Errorf("the remote does not advertise a symbolic HEAD")
+}
+
+// maxSuggestedRefs is the number of refs listed in the error for an
+// unknown ref.
+const maxSuggestedRefs = 5
+
+// describeUnknownRef returns err, the error of resolving ref, with a
+// few of the branches and tags the remote at repoURL advertises when
+// the remote does not have ref. Other errors are returned as is.
+func describeUnknownRef(repoURL, ref string, err error) error {
+	if err == nil || !isUnknownRef(err) {
+		return err
+	}
+	refs, lerr := listRefs(repoURL, "refs/heads/", "refs/tags/")
+	if lerr != nil || len(refs) == 0 {
+		return fmt.Errorf("%v: the remote has no ref %q", err, ref)
+	}
+	var names []string
+	for _, r := range refs {
+		if len(names) == maxSuggestedRefs {
+			names = append(names, "...")
+			break
+		}
+		names = append(names, r.name)
+	}
+	return fmt.Errorf("%v: the remote has no ref %q; available refs include %s",
+		err, ref, strings.Join(names, ", "))
+}
+
+// isUnknownRef reports whether err is the error of resolving a ref
+// the remote does not advertise. rsc.io/gitfs does not type it.
+func isUnknownRef(err error) bool {
+	return strings.HasSuffix(err.Error(), "unknown ref")
+}
+
+// parseRefLine parses a line of the ls-refs output, of the form
+// `<hash> <name> [symref-target:<target>] [peeled:<hash>]`.
+func parseRefLine(line string) (remoteRef, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return remoteRef{}, fmt.Errorf("invalid line: %q", line)
+	}
+	h, err := parseHash(fields[0])
+	if err != nil {
+		return remoteRef{}, fmt.Errorf("invalid line: %q", line)
+	}
+	ref := remoteRef{name: fields[1], hash: h}
+	for _, attr := range fields[2:] {
+		if target, ok := strings.CutPrefix(attr, "symref-target:"); ok {
+			ref.target = target
+		}
+	}
+	return ref, nil
+}
+
+// parseHash parses the hexadecimal form of a hash.
+func parseHash(s string) (gitfs.Hash, error) {
+	var h gitfs.Hash
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("invalid hash %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid hash %q", s)
+	}
+	return h, nil
+}
+
+// writePkt writes s as a single pkt-line.
+func writePkt(w *bytes.Buffer, s string) {
+	fmt.Fprintf(w, "%04x%s", len(s)+4, s)
+}
+
+// readPkt reads a single pkt-line, returning io.EOF on a flush packet.
+// Delimiter packets are skipped.
+func readPkt(r *bufio.Reader) (string, error) {
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		n, err := strconv.ParseUint(string(size[:]), 16, 16)
+		if err != nil || n == 2 || n == 3 {
+			return "", fmt.Errorf("malformed pkt-line")
+		}
+		switch n {
+		case 0:
+			return "", io.EOF
+		case 1:
+			continue
+		}
+		buf := make([]byte, n-4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+}
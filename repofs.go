@@ -0,0 +1,65 @@
+package gitfs
+
+import (
+	"fmt"
+	"io/fs"
+
+	"rsc.io/gitfs"
+)
+
+// An Option configures the filesystem returned by NewRepoFS.
+type Option func(*repoFSOptions)
+
+type repoFSOptions struct {
+	textNormalize *TextNormalize
+}
+
+// WithTextNormalize normalizes the text files matching cfg as they
+// are read, like the `text_normalize` option of the module.
+func WithTextNormalize(cfg *TextNormalize) Option {
+	return func(o *repoFSOptions) {
+		o.textNormalize = cfg
+	}
+}
+
+// NewRepoFS clones the repository at url at ref into memory and returns
+// its tree, for programs and tests that want the git-backed filesystem
+// without running Caddy. The ref accepts the same forms as the module's
+// `ref`, with an empty value meaning HEAD. Like the module, only remotes
+// speaking the git smart HTTP protocol are supported; a local repository
+// can be served with `git http-backend`. The returned filesystem is never
+// refreshed and implements fs.StatFS.
+func NewRepoFS(url, ref string, opts ...Option) (fs.FS, error) {
+	var o repoFSOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.textNormalize != nil && len(o.textNormalize.Extensions) == 0 {
+		return nil, fmt.Errorf("text normalization has no extensions")
+	}
+	if err := validateRef(ref); err != nil {
+		return nil, err
+	}
+	switch ref {
+	case "":
+		ref = "HEAD"
+	case refAuto:
+		branch, err := defaultBranch(url)
+		if err != nil {
+			return nil, fmt.Errorf("detecting the default branch: %v", err)
+		}
+		ref = branch
+	}
+	repo, err := gitfs.NewRepo(url)
+	if err != nil {
+		return nil, err
+	}
+	_, tree, err := repo.Clone(ref)
+	if err != nil {
+		return nil, err
+	}
+	if o.textNormalize != nil {
+		tree = textFS{tree, o.textNormalize}
+	}
+	return statFs{tree}, nil
+}
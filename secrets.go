@@ -0,0 +1,43 @@
+package gitfs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// resolveSecret replaces the placeholders in s, a value that may hold
+// credentials, so they need not be written in the config. Besides the
+// global placeholders such as `{env.*}`, `{file.<path>}` is replaced by
+// the content of the file at path and `{storage.<key>}` by the value
+// stored under key in the configured Caddy storage, both with
+// surrounding whitespace trimmed. Secrets are resolved at provision,
+// so a config reload picks up new values.
+func resolveSecret(ctx caddy.Context, s string) (string, error) {
+	var loadErr error
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (any, bool) {
+		var data []byte
+		var err error
+		if name, ok := strings.CutPrefix(key, "file."); ok {
+			data, err = os.ReadFile(name)
+		} else if name, ok := strings.CutPrefix(key, "storage."); ok {
+			data, err = ctx.Storage().Load(ctx, name)
+		} else {
+			return nil, false
+		}
+		if err != nil {
+			if loadErr == nil {
+				loadErr = err
+			}
+			return nil, false
+		}
+		return strings.TrimSpace(string(data)), true
+	})
+	out, err := repl.ReplaceOrErr(s, true, true)
+	if loadErr != nil {
+		return "", loadErr
+	}
+	return out, err
+}
@@ -0,0 +1,182 @@
+package gitfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Sitemap{})
+	httpcaddyfile.RegisterHandlerDirective("gitfs_sitemap", parseSitemap)
+}
+
+// Sitemap is a handler responding with an XML sitemap of the HTML
+// files in the commit served by a named git filesystem, at whatever
+// path it is routed to. An `index.html` is listed as its directory.
+// The files are listed once per commit, so the sitemap follows every
+// refresh. Clones are shallow and carry no per-file history, so the
+// entries have no `lastmod`.
+type Sitemap struct {
+	// The name of the git filesystem
+	Filesystem string `json:"filesystem,omitempty"`
+
+	// The URL the paths are relative to, e.g. `https://example.com/`.
+	// Default: the scheme and host of the request
+	BaseURL string `json:"base_url,omitempty"`
+
+	base  *url.URL
+	cache *sitemapCache
+}
+
+// sitemapCache holds the paths listed for the snapshot last seen.
+type sitemapCache struct {
+	mu    sync.Mutex
+	snap  *snapshot
+	paths []string
+}
+
+// sitemapURLSet is the root element of a sitemap.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Sitemap) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.gitfs_sitemap",
+		New: func() caddy.Module { return new(Sitemap) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *Sitemap) Provision(ctx caddy.Context) error {
+	if s.Filesystem == "" {
+		return fmt.Errorf("'filesystem' is empty")
+	}
+	if s.BaseURL != "" {
+		u, err := url.Parse(s.BaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("'base_url' %q is not an absolute URL", s.BaseURL)
+		}
+		s.base = u
+	}
+	s.cache = new(sitemapCache)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (s Sitemap) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+	repo, ok := lookupRepo(s.Filesystem)
+	if !ok {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("unknown git filesystem %q", s.Filesystem))
+	}
+	if err := repo.checkHost(r); err != nil {
+		return err
+	}
+	paths, err := s.htmlPaths(repo.current.Load())
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	base := s.base
+	if base == nil {
+		base = &url.URL{Scheme: "http", Host: r.Host, Path: "/"}
+		if r.TLS != nil {
+			base.Scheme = "https"
+		}
+	}
+	set := sitemapURLSet{URLs: make([]sitemapURL, 0, len(paths))}
+	for _, p := range paths {
+		set.URLs = append(set.URLs, sitemapURL{Loc: base.JoinPath(p).String()})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(set)
+}
+
+// htmlPaths returns the URL paths of the HTML files of snap, walking
+// the tree only for a snapshot it has not seen last.
+func (s Sitemap) htmlPaths(snap *snapshot) ([]string, error) {
+	c := s.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.snap == snap {
+		return c.paths, nil
+	}
+	var paths []string
+	err := fs.WalkDir(snap.statFs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !hasExtension(name, []string{".html", ".htm"}) {
+			return err
+		}
+		if path.Base(name) == "index.html" {
+			name = strings.TrimSuffix(name, "index.html")
+		}
+		paths = append(paths, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.snap, c.paths = snap, paths
+	return paths, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	gitfs_sitemap <filesystem> {
+//		base_url <url>
+//	}
+func (s *Sitemap) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// consume the directive
+	d.Next()
+	if !d.Args(&s.Filesystem) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "base_url":
+			if !d.Args(&s.BaseURL) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+func parseSitemap(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var s Sitemap
+	err := s.UnmarshalCaddyfile(h.Dispenser)
+	return s, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Sitemap)(nil)
+	_ caddyhttp.MiddlewareHandler = Sitemap{}
+	_ caddyfile.Unmarshaler       = (*Sitemap)(nil)
+)